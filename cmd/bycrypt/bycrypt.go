@@ -1,36 +1,83 @@
 package main
 
 import (
+	"example/web-go/password"
+	"flag"
 	"fmt"
+	"math"
 	"os"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
+const usage = `usage:
+  bycrypt hash [-algo bcrypt|argon2id] [-cost n] [-time n] [-memory KiB] [-threads n] <password>
+  bycrypt compare <password> <hash>`
+
 func main() {
+	if len(os.Args) < 2 {
+		fmt.Println(usage)
+		os.Exit(2)
+	}
 	switch os.Args[1] {
 	case "hash":
-		hash(os.Args[2])
+		hash(os.Args[2:])
 	case "compare":
+		if len(os.Args) != 4 {
+			fmt.Println(usage)
+			os.Exit(2)
+		}
 		compare(os.Args[3], os.Args[2])
+	default:
+		fmt.Println(usage)
+		os.Exit(2)
 	}
 }
 
-func hash(password string) {
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+func hash(args []string) {
+	flags := flag.NewFlagSet("hash", flag.ExitOnError)
+	algo := flags.String("algo", "bcrypt", "hashing algorithm: bcrypt or argon2id")
+	cost := flags.Int("cost", 0, "bcrypt cost, defaults to bcrypt.DefaultCost")
+	argon2Time := flags.Uint("time", 0, "argon2id passes, defaults to password.DefaultArgon2Time")
+	argon2Memory := flags.Uint("memory", 0, "argon2id memory in KiB, defaults to password.DefaultArgon2Memory")
+	argon2Threads := flags.Uint("threads", 0, "argon2id parallelism, defaults to password.DefaultArgon2Threads")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+
+	var hasher password.Hasher
+	switch *algo {
+	case "bcrypt":
+		hasher = password.Bcrypt{Cost: *cost}
+	case "argon2id":
+		if *argon2Time > math.MaxUint32 || *argon2Memory > math.MaxUint32 || *argon2Threads > math.MaxUint8 {
+			fmt.Println("argon2id parameters out of range")
+			os.Exit(2)
+		}
+		hasher = password.Argon2id{
+			Time:    uint32(*argon2Time),
+			Memory:  uint32(*argon2Memory),
+			Threads: uint8(*argon2Threads),
+		}
+	default:
+		fmt.Printf("unknown algorithm: %s\n", *algo)
+		os.Exit(2)
+	}
 
+	hashed, err := hasher.Hash(flags.Arg(0))
 	if err != nil {
-		fmt.Printf("error hashing: %v\n", password)
-		return
+		fmt.Printf("error hashing: %v\n", err)
+		os.Exit(1)
 	}
 
-	fmt.Println(string(hashedBytes))
+	fmt.Println(hashed)
 }
 
-func compare(hashedPassword, password string) {
-	err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+func compare(hashedPassword, plaintext string) {
+	err := password.Verify(hashedPassword, plaintext)
 	if err != nil {
-		fmt.Printf("Password do not match: %v", password)
+		fmt.Printf("Password do not match: %v\n", err)
+		os.Exit(1)
 	}
 	fmt.Println("Password is correct")
 }
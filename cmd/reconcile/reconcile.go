@@ -0,0 +1,135 @@
+// Command reconcile backfills the images table from the files already stored
+// for each gallery in the configured storage backend. With -dedupe it also
+// moves images stored per gallery into shared blobs, and with -strip-gps it
+// removes the location from photos in galleries that do not keep GPS. It
+// finishes with a report of the storage deduplication saves.
+package main
+
+import (
+	"example/web-go/migrations"
+	"example/web-go/models"
+	"example/web-go/storage"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	prune := flag.Bool("prune", false, "remove image rows whose file no longer exists")
+	galleryID := flag.Int("gallery", 0, "only reconcile the gallery with this ID")
+	dedupe := flag.Bool("dedupe", false, "move images stored per gallery into shared blobs")
+	stripGPS := flag.Bool("strip-gps", false, "remove the location from photos in galleries that do not keep GPS")
+	flag.Parse()
+
+	err := run(*galleryID, *prune, *dedupe, *stripGPS)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(galleryID int, prune, dedupe, stripGPS bool) error {
+	err := godotenv.Load(".env")
+	if err != nil {
+		return fmt.Errorf("load env: %w", err)
+	}
+
+	db, err := models.Open(models.PostgresConfig{
+		Host:     os.Getenv("PSQL_HOST"),
+		Port:     os.Getenv("PSQL_PORT"),
+		User:     os.Getenv("PSQL_USER"),
+		Password: os.Getenv("PSQL_PASSWORD"),
+		DBName:   os.Getenv("PSQL_DBNAME"),
+		SSLMode:  os.Getenv("PSQL_SSLMODE"),
+	})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	err = models.MigrateFS(db, migrations.FS, ".")
+	if err != nil {
+		return err
+	}
+
+	var store storage.Store = storage.Local{Dir: os.Getenv("IMAGES_DIR")}
+	if os.Getenv("STORAGE_BACKEND") == "s3" {
+		store = storage.NewS3(storage.S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          os.Getenv("S3_REGION"),
+			Bucket:          os.Getenv("S3_BUCKET"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			PathStyle:       os.Getenv("S3_PATH_STYLE") == "true",
+		})
+	}
+
+	galleryService := &models.GalleryService{
+		DB:      db,
+		Storage: store,
+	}
+
+	var galleries []models.Gallery
+	if galleryID != 0 {
+		gallery, err := galleryService.ByID(galleryID)
+		if err != nil {
+			return err
+		}
+		galleries = append(galleries, *gallery)
+	} else {
+		galleries, err = galleryService.All()
+		if err != nil {
+			return err
+		}
+	}
+
+	var added, removed, moved, stripped int
+	for _, gallery := range galleries {
+		result, err := galleryService.Reconcile(gallery.ID, prune)
+		if err != nil {
+			return err
+		}
+		for _, filename := range result.Added {
+			fmt.Printf("gallery-%d: added %s\n", gallery.ID, filename)
+		}
+		for _, filename := range result.Removed {
+			fmt.Printf("gallery-%d: removed %s\n", gallery.ID, filename)
+		}
+		added += len(result.Added)
+		removed += len(result.Removed)
+
+		if dedupe {
+			n, err := galleryService.Deduplicate(gallery.ID)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				fmt.Printf("gallery-%d: moved %d images to blobs\n", gallery.ID, n)
+			}
+			moved += n
+		}
+
+		if stripGPS {
+			n, err := galleryService.StripGPS(gallery.ID)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				fmt.Printf("gallery-%d: stripped the location from %d images\n", gallery.ID, n)
+			}
+			stripped += n
+		}
+	}
+
+	fmt.Printf("reconciled %d galleries: %d added, %d removed, %d moved to blobs, %d stripped of GPS\n",
+		len(galleries), added, removed, moved, stripped)
+
+	stats, err := galleryService.DedupStats()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d images share %d blobs: %d bytes stored, %d bytes saved\n",
+		stats.References, stats.Blobs, stats.StoredBytes, stats.SavedBytes())
+	return nil
+}
@@ -1,19 +1,28 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"example/web-go/controllers"
 	"example/web-go/migrations"
 	"example/web-go/models"
+	"example/web-go/password"
+	"example/web-go/storage"
 	"example/web-go/templates"
+	"example/web-go/throttle"
 	"example/web-go/views"
 	"fmt"
 	"net/http"
+	"net/netip"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/csrf"
 	"github.com/joho/godotenv"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type config struct {
@@ -25,6 +34,53 @@ type config struct {
 	}
 	Server struct {
 		Address string
+		// TrustedProxies are the reverse proxies whose X-Forwarded-For and
+		// X-Real-IP headers are believed when resolving client addresses.
+		TrustedProxies []netip.Prefix
+	}
+	Session struct {
+		Duration    time.Duration
+		IdleTimeout time.Duration
+	}
+	// RestrictUnverified keeps unverified users from creating content.
+	RestrictUnverified bool
+
+	Password struct {
+		// Hasher is "bcrypt" (the default) or "argon2id". Existing hashes
+		// are upgraded as users sign in.
+		Hasher     string
+		BcryptCost int
+		// Argon2 holds the argon2id parameters. Raising them upgrades
+		// existing argon2id hashes as users sign in.
+		Argon2 password.Argon2id
+	}
+	// BreachedPasswordsDir holds the breached password hash ranges, see
+	// password.Breached. The check is skipped when empty.
+	BreachedPasswordsDir string
+
+	Throttle struct {
+		// Store is either "memory" (the default) or "postgres" to share
+		// limits between instances.
+		Store string
+	}
+
+	Storage struct {
+		// Backend is either "local" (the default) or "s3".
+		Backend   string
+		ImagesDir string
+		S3        storage.S3Config
+		// MaxDownloadSize caps gallery zip downloads, in bytes.
+		MaxDownloadSize int64
+		// MaxUploadSize caps images sent through resumable uploads, in bytes.
+		MaxUploadSize int64
+		// StagingDir is where resumable uploads are assembled.
+		StagingDir string
+		// Collisions is the policy for uploads named like an existing image.
+		Collisions models.CollisionPolicy
+		// Formats names the image formats uploads may use.
+		Formats []string
+		// MaxPixels caps the width times height of uploaded images.
+		MaxPixels int64
 	}
 }
 
@@ -60,10 +116,172 @@ func loadEnvConfig() (config, error) {
 	cfg.CSRF.Key = os.Getenv("CSRF_KEY")
 	cfg.CSRF.Secure = os.Getenv("CSRF_SECURE") == "true"
 	cfg.Server.Address = os.Getenv("SERVER_ADDRESS")
+	if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+		for _, proxy := range strings.Split(proxies, ",") {
+			proxy = strings.TrimSpace(proxy)
+			prefix, err := netip.ParsePrefix(proxy)
+			if err != nil {
+				addr, addrErr := netip.ParseAddr(proxy)
+				if addrErr != nil {
+					return cfg, fmt.Errorf("parse trusted proxy %q: %w", proxy, err)
+				}
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			cfg.Server.TrustedProxies = append(cfg.Server.TrustedProxies, prefix.Masked())
+		}
+	}
+
+	cfg.Session.Duration, err = parseDuration(os.Getenv("SESSION_DURATION"))
+	if err != nil {
+		return cfg, fmt.Errorf("parse session duration: %w", err)
+	}
+	cfg.Session.IdleTimeout, err = parseDuration(os.Getenv("SESSION_IDLE_TIMEOUT"))
+	if err != nil {
+		return cfg, fmt.Errorf("parse session idle timeout: %w", err)
+	}
+
+	cfg.RestrictUnverified = os.Getenv("RESTRICT_UNVERIFIED") == "true"
+	cfg.Throttle.Store = os.Getenv("THROTTLE_STORE")
+	cfg.BreachedPasswordsDir = os.Getenv("BREACHED_PASSWORDS_DIR")
+	cfg.Password.Hasher = os.Getenv("PASSWORD_HASHER")
+	if costStr := os.Getenv("BCRYPT_COST"); costStr != "" {
+		cfg.Password.BcryptCost, err = strconv.Atoi(costStr)
+		if err != nil {
+			return cfg, fmt.Errorf("parse bcrypt cost: %w", err)
+		}
+		if cfg.Password.BcryptCost < bcrypt.MinCost || cfg.Password.BcryptCost > bcrypt.MaxCost {
+			return cfg, fmt.Errorf("bcrypt cost %d is outside %d to %d", cfg.Password.BcryptCost, bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	}
+	argon2Time, err := parsePositive(os.Getenv("ARGON2_TIME"), 32)
+	if err != nil {
+		return cfg, fmt.Errorf("parse argon2 time: %w", err)
+	}
+	argon2Memory, err := parsePositive(os.Getenv("ARGON2_MEMORY"), 32)
+	if err != nil {
+		return cfg, fmt.Errorf("parse argon2 memory: %w", err)
+	}
+	argon2Threads, err := parsePositive(os.Getenv("ARGON2_THREADS"), 8)
+	if err != nil {
+		return cfg, fmt.Errorf("parse argon2 threads: %w", err)
+	}
+	cfg.Password.Argon2 = password.Argon2id{
+		Time:    uint32(argon2Time),
+		Memory:  uint32(argon2Memory),
+		Threads: uint8(argon2Threads),
+	}
+
+	cfg.Storage.Backend = os.Getenv("STORAGE_BACKEND")
+	cfg.Storage.ImagesDir = os.Getenv("IMAGES_DIR")
+	if maxStr := os.Getenv("DOWNLOAD_MAX_BYTES"); maxStr != "" {
+		cfg.Storage.MaxDownloadSize, err = strconv.ParseInt(maxStr, 10, 64)
+		if err != nil {
+			return cfg, fmt.Errorf("parse download max bytes: %w", err)
+		}
+	}
+	if maxStr := os.Getenv("UPLOAD_MAX_BYTES"); maxStr != "" {
+		cfg.Storage.MaxUploadSize, err = strconv.ParseInt(maxStr, 10, 64)
+		if err != nil {
+			return cfg, fmt.Errorf("parse upload max bytes: %w", err)
+		}
+	}
+	if maxStr := os.Getenv("UPLOAD_MAX_PIXELS"); maxStr != "" {
+		cfg.Storage.MaxPixels, err = strconv.ParseInt(maxStr, 10, 64)
+		if err != nil {
+			return cfg, fmt.Errorf("parse upload max pixels: %w", err)
+		}
+	}
+	cfg.Storage.StagingDir = os.Getenv("UPLOAD_STAGING_DIR")
+	cfg.Storage.Collisions = models.CollisionPolicy(os.Getenv("UPLOAD_COLLISIONS"))
+	if cfg.Storage.Collisions != "" && !models.ValidCollisionPolicy(cfg.Storage.Collisions) {
+		return cfg, fmt.Errorf("unknown upload collision policy: %q", cfg.Storage.Collisions)
+	}
+	if formats := os.Getenv("UPLOAD_FORMATS"); formats != "" {
+		for _, name := range strings.Split(formats, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if !models.ValidFormat(name) {
+				return cfg, fmt.Errorf("unknown upload format: %q", name)
+			}
+			cfg.Storage.Formats = append(cfg.Storage.Formats, name)
+		}
+	}
+	cfg.Storage.S3 = storage.S3Config{
+		Endpoint:        os.Getenv("S3_ENDPOINT"),
+		Region:          os.Getenv("S3_REGION"),
+		Bucket:          os.Getenv("S3_BUCKET"),
+		AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		PathStyle:       os.Getenv("S3_PATH_STYLE") == "true",
+	}
 
 	return cfg, nil
 }
 
+func newStore(cfg config) (storage.Store, error) {
+	switch cfg.Storage.Backend {
+	case "", "local":
+		return storage.Local{Dir: cfg.Storage.ImagesDir}, nil
+	case "s3":
+		if cfg.Storage.S3.Endpoint == "" || cfg.Storage.S3.Bucket == "" {
+			return nil, fmt.Errorf("s3 storage requires S3_ENDPOINT and S3_BUCKET")
+		}
+		return storage.NewS3(cfg.Storage.S3), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %q", cfg.Storage.Backend)
+	}
+}
+
+func newHasher(cfg config) (password.Hasher, error) {
+	switch cfg.Password.Hasher {
+	case "", "bcrypt":
+		return password.Bcrypt{Cost: cfg.Password.BcryptCost}, nil
+	case "argon2id":
+		return cfg.Password.Argon2, nil
+	default:
+		return nil, fmt.Errorf("unknown password hasher: %q", cfg.Password.Hasher)
+	}
+}
+
+// newThrottleStore returns the store for rate limits and a func that forgets
+// idle buckets.
+func newThrottleStore(cfg config, db *sql.DB) (throttle.Store, models.SweepFunc, error) {
+	switch cfg.Throttle.Store {
+	case "", "memory":
+		store := &throttle.Memory{}
+		return store, store.DeleteIdle, nil
+	case "postgres":
+		store := &throttle.Postgres{DB: db}
+		return store, store.DeleteIdle, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown throttle store: %q", cfg.Throttle.Store)
+	}
+}
+
+// parseDuration parses an optional duration, returning zero for an empty value
+// so services fall back to their defaults.
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// parsePositive parses an unsigned integer of the given bit size, where empty
+// means zero so the default applies.
+func parsePositive(s string, bits int) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(s, 10, bits)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	return n, nil
+}
+
 func main() {
 	// load config
 	cfg, err := loadEnvConfig()
@@ -78,6 +296,8 @@ func main() {
 }
 
 func run(cfg config) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	// Setup the database
 	db, err := models.Open(cfg.PSQL)
@@ -91,32 +311,155 @@ func run(cfg config) error {
 	}
 
 	// Setup services
+	hasher, err := newHasher(cfg)
+	if err != nil {
+		return err
+	}
 	userService := &models.UserService{
-		DB: db,
+		DB:     db,
+		Hasher: hasher,
+	}
+	if cfg.BreachedPasswordsDir != "" {
+		info, err := os.Stat(cfg.BreachedPasswordsDir)
+		if err != nil {
+			return fmt.Errorf("breached passwords: %w", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("breached passwords: %s is not a directory", cfg.BreachedPasswordsDir)
+		}
+		userService.PasswordPolicy.Breached = &password.Breached{Dir: cfg.BreachedPasswordsDir}
 	}
 	sessionService := &models.SessionService{
-		DB: db,
+		DB:          db,
+		Duration:    cfg.Session.Duration,
+		IdleTimeout: cfg.Session.IdleTimeout,
 	}
 	passwordResetService := &models.PasswordResetService{
 		DB: db,
 	}
+	emailVerificationService := &models.EmailVerificationService{
+		DB: db,
+	}
+	emailChangeService := &models.EmailChangeService{
+		DB: db,
+	}
+	twoFactorService := &models.TwoFactorService{
+		DB: db,
+	}
+	pendingAuthService := &models.PendingAuthService{
+		DB: db,
+	}
+	jobService := &models.JobService{
+		DB: db,
+	}
+	shareLinkService := &models.ShareLinkService{
+		DB: db,
+	}
+	apiTokenService := &models.APITokenService{
+		DB: db,
+	}
 	emailService := models.NewEmailService(cfg.SMTP)
+	emailService.Jobs = jobService
+	store, err := newStore(cfg)
+	if err != nil {
+		return err
+	}
 	galleryService := &models.GalleryService{
-		DB: db,
+		DB:         db,
+		Storage:    store,
+		Jobs:       jobService,
+		Collisions: cfg.Storage.Collisions,
+		Formats:    cfg.Storage.Formats,
+		MaxPixels:  cfg.Storage.MaxPixels,
 	}
 
+	throttleStore, sweepThrottle, err := newThrottleStore(cfg, db)
+	if err != nil {
+		return err
+	}
+
+	accountDeletionService := &models.AccountDeletionService{
+		DB:        db,
+		Galleries: galleryService,
+	}
+	uploadSessionService := &models.UploadSessionService{
+		DB:         db,
+		Galleries:  galleryService,
+		MaxSize:    cfg.Storage.MaxUploadSize,
+		StagingDir: cfg.Storage.StagingDir,
+	}
+
+	// Setup background workers
+	sweeper := &models.Sweeper{}
+	sweeper.Add("throttle buckets", sweepThrottle)
+	sweeper.Add("sessions", sessionService.DeleteExpired)
+	sweeper.Add("login failures", userService.DeleteStaleLoginFailures)
+	sweeper.Add("password resets", passwordResetService.DeleteExpired)
+	sweeper.Add("email verifications", emailVerificationService.DeleteExpired)
+	sweeper.Add("pending sign ins", pendingAuthService.DeleteExpired)
+	sweeper.Add("email changes", emailChangeService.DeleteExpired)
+	sweeper.Add("deleted accounts", accountDeletionService.Purge)
+	sweeper.Add("share links", shareLinkService.DeleteExpired)
+	sweeper.Add("uploads", uploadSessionService.DeleteExpired)
+	sweeper.Add("unreferenced blobs", galleryService.DeleteUnreferencedBlobs)
+	sweeper.Add("jobs", jobService.DeleteFinished)
+	go sweeper.Run(ctx)
+
+	worker := &models.JobWorker{
+		DB:          db,
+		Concurrency: 2,
+	}
+	worker.Handle(models.JobSendEmail, emailService.HandleSendEmailJob)
+	worker.Handle(models.JobImageRenditions, galleryService.HandleRenditionsJob)
+	go worker.Run(ctx)
+
 	// Setup middelwares
 	umw := controllers.UserMiddleware{
-		SessionService: sessionService,
+		SessionService:     sessionService,
+		RestrictUnverified: cfg.RestrictUnverified,
 	}
-	csrfMw := csrf.Protect([]byte(cfg.CSRF.Key), csrf.Secure(cfg.CSRF.Secure), csrf.Path("/"))
+	csrfMw := csrf.Protect([]byte(cfg.CSRF.Key), csrf.Secure(cfg.CSRF.Secure), csrf.Path("/"),
+		csrf.ErrorHandler(http.HandlerFunc(controllers.CSRFFailure)))
 
 	// Setup Controllers
 	userC := controllers.User{
 		UserService:          userService,
 		SessionService:       sessionService,
+		APITokenService:      apiTokenService,
 		PasswordResetService: passwordResetService,
 		EmailService:         emailService,
+
+		EmailVerificationService: emailVerificationService,
+		TwoFactorService:         twoFactorService,
+		PendingAuthService:       pendingAuthService,
+		EmailChangeService:       emailChangeService,
+		AccountDeletionService:   accountDeletionService,
+		GalleryService:           galleryService,
+
+		SignInThrottle: &controllers.Throttle{
+			PerIP: &throttle.Limiter{
+				Store: throttleStore,
+				Name:  "signin:ip",
+				Limit: throttle.Limit{Burst: 20, Per: 10 * time.Minute},
+			},
+			PerTarget: &throttle.Limiter{
+				Store: throttleStore,
+				Name:  "signin:email",
+				Limit: throttle.Limit{Burst: 10, Per: 15 * time.Minute},
+			},
+		},
+		ForgotPasswordThrottle: &controllers.Throttle{
+			PerIP: &throttle.Limiter{
+				Store: throttleStore,
+				Name:  "forgot-pw:ip",
+				Limit: throttle.Limit{Burst: 5, Per: time.Hour},
+			},
+			PerTarget: &throttle.Limiter{
+				Store: throttleStore,
+				Name:  "forgot-pw:email",
+				Limit: throttle.Limit{Burst: 3, Per: time.Hour},
+			},
+		},
 	}
 	userC.Templates.New = views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "signup.gohtml"))
 	userC.Templates.SignIn = views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "signin.gohtml"))
@@ -124,54 +467,161 @@ func run(cfg config) error {
 	userC.Templates.ResetPassword = views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "reset-pw.gohtml"))
 	userC.Templates.CheckYourEmail = views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "check-your-email.gohtml"))
 	userC.Templates.CheckYourEmail = views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "check-your-email.gohtml"))
+	userC.Templates.Sessions = views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "users/sessions.gohtml"))
+	userC.Templates.VerifyEmail = views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "verify-email.gohtml"))
+	userC.Templates.TwoFactor = views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "signin-2fa.gohtml"))
+	userC.Templates.Security = views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "users/security.gohtml"))
+	userC.Templates.Account = views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "users/account.gohtml"))
+	userC.Templates.EmailChanged = views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "users/email-changed.gohtml"))
+	userC.Templates.APITokens = views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "users/tokens.gohtml"))
 
 	galleriesC := controllers.Galleries{
-		GalleryService: galleryService,
+		GalleryService:   galleryService,
+		ShareLinkService: shareLinkService,
+		MaxDownloadSize:  cfg.Storage.MaxDownloadSize,
+
+		UnlockThrottle: &controllers.Throttle{
+			PerIP: &throttle.Limiter{
+				Store: throttleStore,
+				Name:  "share-unlock:ip",
+				Limit: throttle.Limit{Burst: 10, Per: 10 * time.Minute},
+			},
+			PerTarget: &throttle.Limiter{
+				Store: throttleStore,
+				Name:  "share-unlock:link",
+				Limit: throttle.Limit{Burst: 30, Per: 15 * time.Minute},
+			},
+		},
 	}
 	galleriesC.Templates.Index = views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "galleries/index.gohtml"))
 	galleriesC.Templates.Show = views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "galleries/show.gohtml"))
 	galleriesC.Templates.New = views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "galleries/new.gohtml"))
 	galleriesC.Templates.Edit = views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "galleries/edit.gohtml"))
+	galleriesC.Templates.SharePassword = views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "galleries/share-password.gohtml"))
+
+	apiC := controllers.API{
+		GalleryService:       galleryService,
+		APITokenService:      apiTokenService,
+		UploadSessionService: uploadSessionService,
+	}
 
 	// Setup r and routes
 	r := chi.NewRouter()
-	r.Use(csrfMw)
-	r.Use(umw.SetUser)
-	r.Get("/", controllers.StaticHanlder(views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "home.gohtml"))))
-	r.Get("/contact", controllers.StaticHanlder(views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "contact.gohtml"))))
-	r.Get("/faq", controllers.FAQ(views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "faq.gohtml"))))
-	r.Get("/signup", userC.New)
-	r.Post("/users", userC.Create)
-	r.Get("/signin", userC.SignIn)
-	r.Post("/signin", userC.ProcessSignIn)
-
-	r.Route("/galleries", func(r chi.Router) {
-		r.Get("/{id}", galleriesC.Show)
-		r.Get("/{id}/images/{filename}", galleriesC.Image)
+	clientIPMw := controllers.ClientIPMiddleware{
+		TrustedProxies: cfg.Server.TrustedProxies,
+	}
+	r.Use(clientIPMw.SetClientIP)
+
+	// The API resolves bearer tokens before the CSRF check, which token
+	// authenticated requests skip. SetUser only falls back to the session
+	// cookie for requests without a token.
+	r.Route("/api/v1", func(r chi.Router) {
+		r.Use(apiC.Authenticate)
+		r.Use(csrfMw)
+		r.Use(umw.SetUser)
+		r.Use(apiC.RequireUser)
+		r.Get("/me", apiC.Me)
 		r.Group(func(r chi.Router) {
-			r.Use(umw.RequireUser)
-			r.Get("/new", galleriesC.New)
-			r.Get("/{id}/edit", galleriesC.Edit)
-			r.Post("/{id}/delete", galleriesC.Delete)
-			r.Get("/", galleriesC.Index)
-			r.Get("/{id}", galleriesC.Index)
-			r.Post("/", galleriesC.Create)
-			r.Post("/{id}", galleriesC.Update)
-			r.Post("/{id}/images", galleriesC.UploadImage)
-			r.Post("/{id}/images/{filename}/delete", galleriesC.DeleteImage)
+			r.Use(apiC.RequireScope(models.ScopeGalleriesRead))
+			r.Get("/galleries", apiC.Galleries)
+			r.Get("/galleries/{id}", apiC.Gallery)
+			r.Get("/galleries/{id}/images", apiC.Images)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(apiC.RequireScope(models.ScopeGalleriesWrite))
+			r.Patch("/galleries/{id}", apiC.UpdateGallery)
+			r.Delete("/galleries/{id}", apiC.DeleteGallery)
+			r.Delete("/galleries/{id}/images/{filename}", apiC.DeleteImage)
+			r.With(umw.RequireVerified).Post("/galleries", apiC.CreateGallery)
+			r.With(umw.RequireVerified).Post("/galleries/{id}/images", apiC.UploadImages)
+			r.With(umw.RequireVerified).Post("/galleries/{id}/uploads", apiC.CreateUpload)
+			r.Head("/galleries/{id}/uploads/{uploadID}", apiC.Upload)
+			r.Get("/galleries/{id}/uploads/{uploadID}", apiC.Upload)
+			r.Patch("/galleries/{id}/uploads/{uploadID}", apiC.AppendUpload)
+			r.Delete("/galleries/{id}/uploads/{uploadID}", apiC.DeleteUpload)
 		})
-		r.Get("/{id}", galleriesC.Show)
 	})
 
-	assetHandler := http.FileServer(http.Dir("assets"))
-	r.Get("/assets/*", http.StripPrefix("/assets", assetHandler).ServeHTTP)
+	r.Group(func(r chi.Router) {
+		r.Use(csrfMw)
+		r.Use(umw.SetUser)
+		r.Get("/", controllers.StaticHanlder(views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "home.gohtml"))))
+		r.Get("/contact", controllers.StaticHanlder(views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "contact.gohtml"))))
+		r.Get("/faq", controllers.FAQ(views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "faq.gohtml"))))
+		r.Get("/signup", userC.New)
+		r.Post("/users", userC.Create)
+		r.Get("/signin", userC.SignIn)
+		r.Post("/signin", userC.ProcessSignIn)
+		r.Get("/signin/2fa", userC.SignInTwoFactor)
+		r.Post("/signin/2fa", userC.ProcessSignInTwoFactor)
+
+		r.Route("/galleries", func(r chi.Router) {
+			r.Get("/{id}", galleriesC.Show)
+			r.Get("/{id}/images/{filename}", galleriesC.Image)
+			r.Get("/{id}/download", galleriesC.Download)
+			r.Group(func(r chi.Router) {
+				r.Use(umw.RequireUser)
+				r.Get("/{id}/edit", galleriesC.Edit)
+				r.Post("/{id}/delete", galleriesC.Delete)
+				r.Get("/", galleriesC.Index)
+				r.Get("/{id}", galleriesC.Index)
+				r.Post("/{id}", galleriesC.Update)
+				r.Post("/{id}/images/{filename}/delete", galleriesC.DeleteImage)
+				r.Post("/{id}/share-links/{linkID}/delete", galleriesC.DeleteShareLink)
+				r.Group(func(r chi.Router) {
+					r.Use(umw.RequireVerified)
+					r.Get("/new", galleriesC.New)
+					r.Post("/", galleriesC.Create)
+					r.Post("/{id}/images", galleriesC.UploadImage)
+					r.Post("/{id}/share-links", galleriesC.CreateShareLink)
+				})
+			})
+			r.Get("/{id}", galleriesC.Show)
+		})
+
+		r.Get("/g/{slug}", galleriesC.ShowUnlisted)
+		r.Get("/g/{slug}/images/{filename}", galleriesC.UnlistedImage)
+		r.Get("/g/{slug}/download", galleriesC.UnlistedDownload)
+		r.Get("/s/{token}", galleriesC.ShowShared)
+		r.Post("/s/{token}", galleriesC.UnlockShared)
+		r.Get("/s/{token}/images/{filename}", galleriesC.SharedImage)
+		r.Get("/s/{token}/download", galleriesC.SharedDownload)
+
+		assetHandler := http.FileServer(http.Dir("assets"))
+		r.Get("/assets/*", http.StripPrefix("/assets", assetHandler).ServeHTTP)
 
-	r.Post("/signout", userC.ProcessSignOut)
-	r.Get("/forgot-pw", userC.ForgotPassword)
-	r.Post("/forgot-pw", userC.ProcessForgotPassword)
-	r.Get("/reset-pw", userC.ResetPassword)
-	r.Post("/reset-pw", userC.ProcessResetPassword)
-	r.NotFound(controllers.StaticHanlder(views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "notFound.gohtml"))))
+		r.Post("/signout", userC.ProcessSignOut)
+		r.Get("/forgot-pw", userC.ForgotPassword)
+		r.Post("/forgot-pw", userC.ProcessForgotPassword)
+		r.Get("/reset-pw", userC.ResetPassword)
+		r.Post("/reset-pw", userC.ProcessResetPassword)
+		r.Get("/verify-email", userC.VerifyEmail)
+		r.With(umw.RequireUser).Post("/verify-email/resend", userC.ResendVerification)
+		// The token proves who is confirming, so the link works signed out.
+		r.Get("/users/me/email/confirm", userC.ConfirmEmailChange)
+		r.Route("/users/me", func(r chi.Router) {
+			r.Use(umw.RequireUser)
+			r.Get("/", userC.Account)
+			r.Post("/password", userC.ChangePassword)
+			r.Post("/email", userC.ChangeEmail)
+			r.Get("/export", userC.Export)
+			r.Post("/delete", userC.DeleteAccount)
+			r.Post("/delete/cancel", userC.CancelAccountDeletion)
+			r.Get("/sessions", userC.Sessions)
+			r.Post("/sessions/delete-others", userC.RevokeOtherSessions)
+			r.Post("/sessions/{id}/delete", userC.RevokeSession)
+			r.Get("/tokens", userC.APITokens)
+			r.Post("/tokens", userC.CreateAPIToken)
+			r.Post("/tokens/{id}/delete", userC.RevokeAPIToken)
+			r.Get("/security", userC.Security)
+			r.Post("/security/totp", userC.BeginTwoFactor)
+			r.Post("/security/totp/confirm", userC.ConfirmTwoFactor)
+			r.Post("/security/totp/disable", userC.DisableTwoFactor)
+			r.Post("/security/recovery-codes", userC.RegenerateRecoveryCodes)
+		})
+	})
+	notFound := controllers.StaticHanlder(views.Must(views.ParseFS(templates.FS, "layout-page.gohtml", "notFound.gohtml")))
+	r.NotFound(csrfMw(umw.SetUser(notFound)).ServeHTTP)
 
 	// Start the server
 	fmt.Printf("The server is listeing on: %s...\n", cfg.Server.Address)
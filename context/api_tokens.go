@@ -0,0 +1,27 @@
+package context
+
+import (
+	"context"
+	"example/web-go/models"
+)
+
+const (
+	apiTokenKey key = "apiToken"
+)
+
+// WithAPIToken records that the request was authenticated with token rather
+// than a session cookie.
+func WithAPIToken(ctx context.Context, token *models.APIToken) context.Context {
+	return context.WithValue(ctx, apiTokenKey, token)
+}
+
+func APIToken(ctx context.Context) *models.APIToken {
+	val := ctx.Value(apiTokenKey)
+	token, ok := val.(*models.APIToken)
+
+	if !ok {
+		return nil
+	}
+
+	return token
+}
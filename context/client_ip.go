@@ -0,0 +1,20 @@
+package context
+
+import (
+	"context"
+)
+
+const (
+	clientIPKey key = "clientIP"
+)
+
+// WithClientIP records the address of the client that sent the request, as
+// resolved from trusted proxy headers.
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey, ip)
+}
+
+func ClientIP(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey).(string)
+	return ip
+}
@@ -0,0 +1,253 @@
+package controllers
+
+import (
+	"example/web-go/context"
+	"example/web-go/errors"
+	"example/web-go/models"
+	"example/web-go/password"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+func (u User) Account(w http.ResponseWriter, r *http.Request) {
+	u.renderAccount(w, r, "")
+}
+
+func (u User) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	current := r.FormValue("current_password")
+	newPassword := r.FormValue("new_password")
+
+	err := u.UserService.ChangePassword(user.ID, current, newPassword)
+	if err != nil {
+		var pwErr password.Error
+		var locked models.LockedError
+		switch {
+		case errors.Is(err, models.ErrInvalidCredentials):
+			err = errors.Public(err, "Your current password is incorrect.")
+		case errors.As(err, &locked):
+			err = lockedError(err, locked)
+		case errors.As(err, &pwErr):
+			err = errors.Public(err, pwErr.Issue)
+		}
+		u.renderAccount(w, r, "", err)
+		return
+	}
+
+	// Whoever knew the old password should not stay signed in elsewhere.
+	token, err := readCookie(r, CookieSession)
+	if err == nil {
+		err = u.SessionService.DeleteOthers(user.ID, token)
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	u.renderAccount(w, r, "Your password has been changed and your other devices have been signed out.")
+}
+
+func (u User) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	newEmail := normalizeEmail(r.FormValue("email"))
+
+	err := u.reauthenticate(r)
+	if err != nil {
+		u.renderAccount(w, r, "", err)
+		return
+	}
+	if newEmail == "" || newEmail == user.Email {
+		err = errors.Public(fmt.Errorf("change email: unchanged"), "Enter a new email address.")
+		u.renderAccount(w, r, "", err)
+		return
+	}
+
+	change, err := u.EmailChangeService.Create(user.ID, newEmail)
+	if err != nil {
+		if errors.Is(err, models.ErrEmailTaken) {
+			err = errors.Public(err, "Email is already in use.")
+		}
+		u.renderAccount(w, r, "", err)
+		return
+	}
+
+	vals := url.Values{
+		"token": {change.Token},
+	}
+	confirmURL := absoluteURL(r, "/users/me/email/confirm?"+vals.Encode())
+	err = u.EmailService.ConfirmEmailChange(change.NewEmail, confirmURL)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = u.EmailService.EmailChangeRequested(user.Email, change.NewEmail)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	u.renderAccount(w, r, fmt.Sprintf("We have sent a confirmation link to %s. Your email changes once you follow it.", change.NewEmail))
+}
+
+// ConfirmEmailChange follows the link sent to the new address. The token
+// proves who is confirming, so the link also works signed out or on another
+// device; the account page is only shown to the user it belongs to.
+func (u User) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Email string
+	}
+	user := context.User(r.Context())
+
+	changed, err := u.EmailChangeService.Consume(r.FormValue("token"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrTokenExpired), errors.Is(err, models.ErrTokenInvalid):
+			err = errors.Public(err, "This confirmation link is invalid or has expired.")
+		case errors.Is(err, models.ErrEmailTaken):
+			err = errors.Public(err, "Email is already in use.")
+		}
+		if user != nil {
+			u.renderAccount(w, r, "", err)
+			return
+		}
+		u.Templates.EmailChanged.Execute(w, r, data, err)
+		return
+	}
+	if user != nil && user.ID == changed.ID {
+		u.renderAccount(w, r, fmt.Sprintf("The email address has been changed to %s.", changed.Email))
+		return
+	}
+	data.Email = changed.Email
+	u.Templates.EmailChanged.Execute(w, r, data)
+}
+
+// Export streams a zip of all of the user's galleries.
+func (u User) Export(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	filename := fmt.Sprintf("galleries-%s.zip", time.Now().Format(time.DateOnly))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	err := u.GalleryService.Export(w, user.ID)
+	if err != nil {
+		// The archive is already on its way; all we can do is cut it
+		// short so the client sees a broken download.
+		fmt.Println(err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// DeleteAccount schedules the account for deletion after the user proves it
+// is them again, with their password and second factor if enabled.
+func (u User) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	err := u.reauthenticate(r)
+	if err != nil {
+		u.renderAccount(w, r, "", err)
+		return
+	}
+
+	deleteAfter, err := u.AccountDeletionService.Schedule(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.renderAccount(w, r, fmt.Sprintf("Your account will be deleted on %s. You can cancel until then.",
+		deleteAfter.Format(time.DateOnly)))
+}
+
+// reauthenticate checks the password, and the second factor if enabled, that
+// the signed in user sent with a sensitive change. Failures are returned as
+// public errors ready to render.
+func (u User) reauthenticate(r *http.Request) error {
+	user := context.User(r.Context())
+	err := u.UserService.CheckPassword(user.ID, r.FormValue("password"))
+	if err != nil {
+		var locked models.LockedError
+		switch {
+		case errors.Is(err, models.ErrInvalidCredentials):
+			err = errors.Public(err, "Your password is incorrect.")
+		case errors.As(err, &locked):
+			err = lockedError(err, locked)
+		}
+		return err
+	}
+	account, err := u.UserService.ByID(user.ID)
+	if err != nil {
+		return err
+	}
+	if account.TOTPEnabled {
+		err = u.TwoFactorService.Verify(user.ID, r.FormValue("code"))
+		if err != nil {
+			if errors.Is(err, models.ErrInvalidCode) {
+				err = errors.Public(err, "The authentication code is incorrect.")
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func lockedError(err error, locked models.LockedError) error {
+	minutes := int(math.Ceil(time.Until(locked.Until).Minutes()))
+	msg := "Too many incorrect passwords. Please try again in a minute."
+	if minutes > 1 {
+		msg = fmt.Sprintf("Too many incorrect passwords. Please try again in %d minutes.", minutes)
+	}
+	return errors.Public(err, msg)
+}
+
+func (u User) CancelAccountDeletion(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	err := u.AccountDeletionService.Cancel(user.ID)
+	if err != nil {
+		if errors.Is(err, models.ErrPurging) {
+			err = errors.Public(err, "Your account is already being deleted and can no longer be kept.")
+			u.renderAccount(w, r, "", err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.renderAccount(w, r, "Your account will not be deleted.")
+}
+
+func (u User) renderAccount(w http.ResponseWriter, r *http.Request, notice string, errs ...error) {
+	var data struct {
+		Email        string
+		Verified     bool
+		TOTPEnabled  bool
+		CreatedAt    string
+		PendingEmail string
+		DeleteAfter  string
+		Notice       string
+	}
+	user, err := u.UserService.ByID(context.User(r.Context()).ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Email = user.Email
+	data.Verified = user.Verified()
+	data.TOTPEnabled = user.TOTPEnabled
+	data.CreatedAt = user.CreatedAt.Format(time.DateOnly)
+	data.Notice = notice
+	if !user.DeleteAfter.IsZero() {
+		data.DeleteAfter = user.DeleteAfter.Format(time.DateOnly)
+	}
+
+	change, err := u.EmailChangeService.Pending(user.ID)
+	switch {
+	case err == nil:
+		data.PendingEmail = change.NewEmail
+	case !errors.Is(err, models.ErrNotFound):
+		fmt.Println(err)
+	}
+
+	u.Templates.Account.Execute(w, r, data, errs...)
+}
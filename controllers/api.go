@@ -0,0 +1,473 @@
+package controllers
+
+import (
+	"encoding/json"
+	"example/web-go/context"
+	"example/web-go/errors"
+	"example/web-go/models"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/csrf"
+)
+
+// API serves the versioned JSON API. It shares the services of the HTML
+// controllers; only the representation differs.
+type API struct {
+	GalleryService       *models.GalleryService
+	APITokenService      *models.APITokenService
+	UploadSessionService *models.UploadSessionService
+	// MaxChunkSize caps each chunk of a resumable upload. Defaults to
+	// DefaultMaxChunkSize.
+	MaxChunkSize int64
+}
+
+// apiError is an error with a fixed status and machine readable code.
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e apiError) Error() string {
+	return fmt.Sprintf("api: %s: %s", e.code, e.message)
+}
+
+var (
+	errAPIUnauthorized = apiError{http.StatusUnauthorized, "unauthorized", "Authentication required."}
+	errAPIForbidden    = apiError{http.StatusForbidden, "forbidden", "You do not have access to this resource."}
+	errAPINotFound     = apiError{http.StatusNotFound, "not_found", "The requested resource could not be found."}
+	errAPIInvalidToken = apiError{http.StatusUnauthorized, "invalid_token", "The API token is invalid or has been revoked."}
+	errAPIScope        = apiError{http.StatusForbidden, "insufficient_scope", "The API token does not grant access to this resource."}
+)
+
+type apiUser struct {
+	ID    int    `json:"id"`
+	Email string `json:"email"`
+}
+
+type apiGallery struct {
+	ID         int    `json:"id"`
+	Title      string `json:"title"`
+	Visibility string `json:"visibility"`
+	KeepGPS    bool   `json:"keep_gps"`
+	URL        string `json:"url"`
+	// Images is only included when a single gallery is requested.
+	Images []apiImage `json:"images,omitempty"`
+}
+
+type apiImage struct {
+	Filename    string            `json:"filename"`
+	DisplayName string            `json:"display_name"`
+	ContentType string            `json:"content_type"`
+	Size        int64             `json:"size"`
+	Width       int               `json:"width"`
+	Height      int               `json:"height"`
+	SHA256      string            `json:"sha256"`
+	Caption     string            `json:"caption"`
+	Position    int               `json:"position"`
+	UploadedAt  time.Time         `json:"uploaded_at"`
+	URLs        map[string]string `json:"urls"`
+}
+
+func newAPIGallery(gallery *models.Gallery) apiGallery {
+	return apiGallery{
+		ID:         gallery.ID,
+		Title:      gallery.Title,
+		Visibility: gallery.Visibility,
+		KeepGPS:    gallery.KeepGPS,
+		URL:        galleryPath(gallery),
+	}
+}
+
+func newAPIImage(gallery *models.Gallery, img models.Image) apiImage {
+	href := galleryPath(gallery) + "/images/" + url.PathEscape(img.Filename)
+	urls := make(map[string]string)
+	for _, rendition := range img.Renditions() {
+		if rendition.Size == models.SizeOriginal {
+			urls[rendition.Size] = href
+			continue
+		}
+		urls[rendition.Size] = href + "?size=" + rendition.Size
+	}
+	return apiImage{
+		Filename:    img.Filename,
+		DisplayName: img.DisplayName,
+		ContentType: img.ContentType,
+		Size:        img.Size,
+		Width:       img.Width,
+		Height:      img.Height,
+		SHA256:      img.SHA256,
+		Caption:     img.Caption,
+		Position:    img.Position,
+		UploadedAt:  img.UploadedAt,
+		URLs:        urls,
+	}
+}
+
+// Authenticate resolves an "Authorization: Bearer" header into the request's
+// user. Token authenticated requests carry no cookies, so they are exempt from
+// CSRF checks; it must run before the CSRF middleware. Requests without the
+// header fall through to the session cookie.
+func (a API) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			if header == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			scheme, token, ok := strings.Cut(header, " ")
+			if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				writeAPIError(w, errAPIInvalidToken)
+				return
+			}
+			user, apiToken, err := a.APITokenService.User(strings.TrimSpace(token))
+			if err != nil {
+				if !errors.Is(err, models.ErrNotFound) {
+					fmt.Println(err)
+				}
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				writeAPIError(w, errAPIInvalidToken)
+				return
+			}
+			ctx := r.Context()
+			ctx = context.WithUser(ctx, user)
+			ctx = context.WithAPIToken(ctx, apiToken)
+			r = csrf.UnsafeSkipCheck(r.WithContext(ctx))
+			next.ServeHTTP(w, r)
+		},
+	)
+}
+
+// RequireScope rejects token authenticated requests whose token lacks scope.
+// Session authenticated requests act with the user's full permissions.
+func (a API) RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				token := context.APIToken(r.Context())
+				if token != nil && !token.HasScope(scope) {
+					writeAPIError(w, errAPIScope)
+					return
+				}
+				next.ServeHTTP(w, r)
+			},
+		)
+	}
+}
+
+// RequireUser rejects unauthenticated requests with a JSON 401. It also
+// exposes the CSRF token, which cookie authenticated clients must echo in the
+// X-CSRF-Token header of unsafe requests.
+func (a API) RequireUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-CSRF-Token", csrf.Token(r))
+			if context.User(r.Context()) == nil {
+				writeAPIError(w, errAPIUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		},
+	)
+}
+
+func (a API) Me(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	writeJSON(w, http.StatusOK, apiUser{ID: user.ID, Email: user.Email})
+}
+
+func (a API) Galleries(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	galleries, err := a.GalleryService.ByUserID(user.ID)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	resp := []apiGallery{}
+	for _, gallery := range galleries {
+		resp = append(resp, newAPIGallery(&gallery))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (a API) CreateGallery(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Title      string `json:"title"`
+		Visibility string `json:"visibility"`
+	}
+	err := readJSON(r, &req)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if req.Title == "" {
+		writeAPIError(w, apiError{http.StatusBadRequest, "invalid_request", "title is required."})
+		return
+	}
+	if req.Visibility != "" && !models.ValidVisibility(req.Visibility) {
+		writeAPIError(w, apiError{http.StatusBadRequest, "invalid_request", "visibility must be private, unlisted or public."})
+		return
+	}
+
+	user := context.User(r.Context())
+	gallery, err := a.GalleryService.Create(req.Title, user.ID)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if req.Visibility != "" && req.Visibility != gallery.Visibility {
+		gallery.Visibility = req.Visibility
+		err = a.GalleryService.Update(gallery)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusCreated, newAPIGallery(gallery))
+}
+
+func (a API) Gallery(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, false)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	images, err := a.GalleryService.Images(gallery.ID)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	resp := newAPIGallery(gallery)
+	resp.Images = []apiImage{}
+	for _, img := range images {
+		resp.Images = append(resp.Images, newAPIImage(gallery, img))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (a API) UpdateGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, true)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var req struct {
+		Title      *string `json:"title"`
+		Visibility *string `json:"visibility"`
+		KeepGPS    *bool   `json:"keep_gps"`
+	}
+	err = readJSON(r, &req)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if req.Title != nil {
+		if *req.Title == "" {
+			writeAPIError(w, apiError{http.StatusBadRequest, "invalid_request", "title must not be empty."})
+			return
+		}
+		gallery.Title = *req.Title
+	}
+	if req.Visibility != nil {
+		if !models.ValidVisibility(*req.Visibility) {
+			writeAPIError(w, apiError{http.StatusBadRequest, "invalid_request", "visibility must be private, unlisted or public."})
+			return
+		}
+		gallery.Visibility = *req.Visibility
+	}
+	if req.KeepGPS != nil {
+		gallery.KeepGPS = *req.KeepGPS
+	}
+
+	err = a.GalleryService.Update(gallery)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIGallery(gallery))
+}
+
+func (a API) DeleteGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, true)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	err = a.GalleryService.Delete(gallery.ID)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a API) Images(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, false)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	images, err := a.GalleryService.Images(gallery.ID)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	resp := []apiImage{}
+	for _, img := range images {
+		resp = append(resp, newAPIImage(gallery, img))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// UploadImages accepts the same multipart "images" field as the HTML form.
+func (a API) UploadImages(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, true)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	err = r.ParseMultipartForm(5 << 20) // 5mb
+	if err != nil {
+		writeAPIError(w, apiError{http.StatusBadRequest, "invalid_request", "Expected a multipart form with an images field."})
+		return
+	}
+
+	resp := []apiImage{}
+	for _, fileHeader := range r.MultipartForm.File["images"] {
+		file, err := fileHeader.Open()
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		img, err := a.GalleryService.CreateImage(gallery.ID, fileHeader.Filename, file)
+		file.Close()
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		resp = append(resp, newAPIImage(gallery, img))
+	}
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+func (a API) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, true)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	err = a.GalleryService.DeleteImage(gallery.ID, filepath.Base(chi.URLParam(r, "filename")))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// gallery loads the gallery from the URL. Galleries the user cannot see are
+// reported as missing; mustOwn additionally requires ownership.
+func (a API) gallery(r *http.Request, mustOwn bool) (*models.Gallery, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return nil, errAPINotFound
+	}
+	gallery, err := a.GalleryService.ByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	user := context.User(r.Context())
+	owner := user != nil && user.ID == gallery.UserID
+	if !owner && gallery.Visibility != models.VisibilityPublic {
+		return nil, errAPINotFound
+	}
+	if mustOwn && !owner {
+		return nil, errAPIForbidden
+	}
+	return gallery, nil
+}
+
+func readJSON(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		return apiError{http.StatusBadRequest, "invalid_json", "The request body is not valid JSON."}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// writeAPIError maps err onto a status code and writes it as
+// {"error": {"code": ..., "message": ...}}. Unknown errors are logged and
+// reported without details.
+func writeAPIError(w http.ResponseWriter, err error) {
+	apiErr := apiError{http.StatusInternalServerError, "internal_error", "Something went wrong."}
+
+	var ae apiError
+	var fileErr models.FileError
+	var offsetErr models.UploadOffsetError
+	var pubErr interface{ Public() string }
+	switch {
+	case errors.As(err, &ae):
+		apiErr = ae
+	case errors.Is(err, models.ErrNotFound):
+		apiErr = errAPINotFound
+	case errors.Is(err, models.ErrImageExists):
+		apiErr = apiError{http.StatusConflict, "image_exists", "An image with that name already exists in the gallery."}
+	case errors.Is(err, models.ErrEmailTaken):
+		apiErr = apiError{http.StatusConflict, "email_taken", "Email is already in use."}
+	case errors.Is(err, models.ErrFinishing):
+		apiErr = apiError{http.StatusConflict, "upload_finishing", "The upload is already being finished."}
+	case errors.As(err, &offsetErr):
+		apiErr = apiError{http.StatusConflict, "offset_mismatch",
+			fmt.Sprintf("The upload continues at offset %d.", offsetErr.Offset)}
+	case errors.As(err, &fileErr):
+		apiErr = apiError{http.StatusBadRequest, "invalid_file", fileErr.Error()}
+	case errors.As(err, &pubErr):
+		apiErr = apiError{http.StatusBadRequest, "invalid_request", pubErr.Public()}
+	default:
+		fmt.Println(err)
+	}
+
+	var body struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	body.Error.Code = apiErr.code
+	body.Error.Message = apiErr.message
+	writeJSON(w, apiErr.status, body)
+}
+
+// CSRFFailure answers requests rejected by the CSRF middleware, using a JSON
+// body for API requests.
+func CSRFFailure(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeAPIError(w, apiError{http.StatusForbidden, "csrf_invalid", csrf.FailureReason(r).Error()})
+		return
+	}
+	http.Error(w, fmt.Sprintf("%s - %s", http.StatusText(http.StatusForbidden), csrf.FailureReason(r)), http.StatusForbidden)
+}
@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"example/web-go/context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ClientIPMiddleware resolves the address of the client behind any trusted
+// reverse proxies. Forwarding headers are ignored unless the request comes
+// from one of TrustedProxies, since anybody can send them.
+type ClientIPMiddleware struct {
+	TrustedProxies []netip.Prefix
+}
+
+func (mw ClientIPMiddleware) SetClientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := mw.resolve(r)
+		r = r.WithContext(context.WithClientIP(r.Context(), ip))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// resolve walks X-Forwarded-For from the nearest hop back and returns the
+// first address that is not a trusted proxy. Proxies append to the header,
+// so entries left of that address were supplied by the client and cannot be
+// trusted. X-Real-IP is used when the proxy only sets that.
+func (mw ClientIPMiddleware) resolve(r *http.Request) string {
+	remote := remoteIP(r)
+	if !mw.trusted(remote) {
+		return remote
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		if !mw.trusted(addr.Unmap().String()) {
+			return addr.Unmap().String()
+		}
+	}
+	if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return addr.Unmap().String()
+	}
+	return remote
+}
+
+func (mw ClientIPMiddleware) trusted(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range mw.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that sent r without the port.
+// Behind a trusted proxy this is the address SetClientIP resolved.
+func clientIP(r *http.Request) string {
+	if ip := context.ClientIP(r.Context()); ip != "" {
+		return ip
+	}
+	return remoteIP(r)
+}
+
+// remoteIP returns the address of the peer connected to the server.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// absoluteURL turns path into a URL on the host the request was sent to.
+func absoluteURL(r *http.Request, path string) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + path
+}
@@ -3,10 +3,12 @@ package controllers
 import (
 	"fmt"
 	"net/http"
+	"time"
 )
 
 const (
-	CookieSession = "session"
+	CookieSession     = "session"
+	CookiePendingAuth = "pending_auth"
 )
 
 func newCookie(name, value string) *http.Cookie {
@@ -23,6 +25,17 @@ func setCookie(w http.ResponseWriter, name, value string) {
 	http.SetCookie(w, newCookie(name, value))
 }
 
+// setCookieExpires sets a persistent cookie that the browser drops at expires.
+func setCookieExpires(w http.ResponseWriter, name, value string, expires time.Time) {
+	cookie := newCookie(name, value)
+	cookie.Expires = expires
+	cookie.MaxAge = int(time.Until(expires).Seconds())
+	if cookie.MaxAge <= 0 {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
 func readCookie(r *http.Request, name string) (string, error) {
 	cookie, err := r.Cookie(name)
 
@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"example/web-go/models"
+	"fmt"
+	"mime"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// DefaultMaxDownloadSize caps the images in a single gallery download.
+const DefaultMaxDownloadSize = 1 << 30
+
+// Download streams a zip of every image in a gallery the visitor may view.
+func (g Galleries) Download(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userCanViewGallery)
+	if err != nil {
+		return
+	}
+	g.download(w, r, gallery)
+}
+
+func (g Galleries) UnlistedDownload(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryBySlug(w, r)
+	if err != nil {
+		return
+	}
+	g.download(w, r, gallery)
+}
+
+func (g Galleries) SharedDownload(w http.ResponseWriter, r *http.Request) {
+	link, err := g.shareLink(w, r)
+	if err != nil {
+		return
+	}
+	if !g.shareUnlocked(r, link) {
+		http.Redirect(w, r, sharePath(chi.URLParam(r, "token")), http.StatusFound)
+		return
+	}
+
+	gallery, err := g.GalleryService.ByID(link.GalleryID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something Went Wrong", http.StatusInternalServerError)
+		return
+	}
+	g.download(w, r, gallery)
+}
+
+func (g Galleries) download(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) {
+	images, err := g.GalleryService.Images(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something Went Wrong", http.StatusInternalServerError)
+		return
+	}
+
+	// Check the cap up front; once streaming starts the status is sent.
+	var total int64
+	for _, image := range images {
+		total += image.Size
+	}
+	if total > g.maxDownloadSize() {
+		http.Error(w, "This gallery is too large to download at once", http.StatusForbidden)
+		return
+	}
+
+	filename := gallery.ArchiveName() + ".zip"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	err = g.GalleryService.WriteZip(w, images)
+	if err != nil {
+		fmt.Println(err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (g Galleries) maxDownloadSize() int64 {
+	if g.MaxDownloadSize == 0 {
+		return DefaultMaxDownloadSize
+	}
+	return g.MaxDownloadSize
+}
@@ -3,12 +3,18 @@ package controllers
 import (
 	"errors"
 	"example/web-go/context"
+	"example/web-go/imaging"
 	"example/web-go/models"
 	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 )
@@ -19,14 +25,24 @@ type Galleries struct {
 		Show  Template
 		Edit  Template
 		Index Template
-	}
-	GalleryService *models.GalleryService
+		// SharePassword asks for the password of a protected share link.
+		SharePassword Template
+	}
+	GalleryService   *models.GalleryService
+	ShareLinkService *models.ShareLinkService
+	// MaxDownloadSize is the largest gallery, in bytes, that can be
+	// downloaded as a zip. Defaults to DefaultMaxDownloadSize.
+	MaxDownloadSize int64
+	// UnlockThrottle limits guesses at share link passwords. It may be nil
+	// to allow unlimited attempts.
+	UnlockThrottle *Throttle
 }
 
 func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	type Gallery struct {
-		ID    int
-		Title string
+		ID         int
+		Title      string
+		Visibility string
 	}
 	var data struct {
 		Galleries []Gallery
@@ -42,8 +58,9 @@ func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 
 	for _, gallery := range galleries {
 		data.Galleries = append(data.Galleries, Gallery{
-			ID:    gallery.ID,
-			Title: gallery.Title,
+			ID:         gallery.ID,
+			Title:      gallery.Title,
+			Visibility: gallery.Visibility,
 		})
 	}
 
@@ -77,20 +94,30 @@ func (g Galleries) Create(w http.ResponseWriter, r *http.Request) {
 }
 
 func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
+	gallery, err := g.galleryByID(w, r, userCanViewGallery)
 	if err != nil {
-		http.Error(w, "Something Went Wrong", http.StatusInternalServerError)
 		return
 	}
-	type Image struct {
-		GalleryID       int
-		Filename        string
-		FilenameEscaped string
+	g.renderShow(w, r, gallery, galleryPath(gallery))
+}
+
+// ShowUnlisted renders a gallery reached through its unlisted slug.
+func (g Galleries) ShowUnlisted(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryBySlug(w, r)
+	if err != nil {
+		return
 	}
+	g.renderShow(w, r, gallery, unlistedPath(gallery))
+}
+
+// renderShow renders the show template with image URLs below basePath, so
+// visitors keep using the same access path for the images.
+func (g Galleries) renderShow(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, basePath string) {
 	var data struct {
-		ID     int
-		Title  string
-		Images []Image
+		ID          int
+		Title       string
+		Images      []galleryImage
+		DownloadURL string
 	}
 
 	data.ID = gallery.ID
@@ -103,12 +130,20 @@ func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	metadata, err := g.GalleryService.ImageMetadata(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something Went Wrong", http.StatusInternalServerError)
+		return
+	}
+
 	for _, img := range images {
-		data.Images = append(data.Images, Image{
-			GalleryID:       img.GalleryID,
-			Filename:        img.Filename,
-			FilenameEscaped: url.PathEscape(img.Filename),
-		})
+		gi := newGalleryImage(basePath, img)
+		gi.Metadata = newImageMetadata(metadata[img.ID])
+		data.Images = append(data.Images, gi)
+	}
+	if len(images) > 0 {
+		data.DownloadURL = basePath + "/download"
 	}
 
 	g.Templates.Show.Execute(w, r, data)
@@ -117,23 +152,72 @@ func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
 func (g Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
 	if err != nil {
-		http.Error(w, "Something Went Wrong", http.StatusInternalServerError)
 		return
 	}
+	g.renderEdit(w, r, gallery, editNotice{})
+}
+
+// editNotice carries results of a form submission that are shown once on the
+// edit page instead of redirecting back to it.
+type editNotice struct {
+	// ShareURL is the URL of a share link that was just created. Its token
+	// cannot be recovered later.
+	ShareURL string
+	// Uploads lists what happened to each file unpacked from an uploaded
+	// zip archive.
+	Uploads []uploadResult
+}
 
-	type Image struct {
-		GalleryID       int
-		Filename        string
-		FilenameEscaped string
+type uploadResult struct {
+	// Name is the file as the user uploaded it, including any folders
+	// inside an archive.
+	Name string
+	// SavedAs is set when the image was stored under a different name,
+	// because it was sanitized or clashed with an existing image.
+	SavedAs string
+	Error   string
+}
+
+func (g Galleries) renderEdit(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, notice editNotice, errs ...error) {
+	type ShareLink struct {
+		ID        int
+		CreatedAt string
+		ExpiresAt string
+		Expired   bool
+		Protected bool
+		Views     int
 	}
 	var data struct {
-		ID     int
-		Title  string
-		Images []Image
+		ID            int
+		Title         string
+		Visibility    string
+		Visibilities  []string
+		KeepGPS       bool
+		UnlistedPath  string
+		Images        []galleryImage
+		ShareLinks    []ShareLink
+		Notice        editNotice
+		UploadAccept  string
+		UploadFormats string
 	}
 
 	data.ID = gallery.ID
 	data.Title = gallery.Title
+	data.Visibility = gallery.Visibility
+	data.Visibilities = []string{models.VisibilityPrivate, models.VisibilityUnlisted, models.VisibilityPublic}
+	data.KeepGPS = gallery.KeepGPS
+	if gallery.Visibility == models.VisibilityUnlisted {
+		data.UnlistedPath = unlistedPath(gallery)
+	}
+	data.Notice = notice
+	formats := g.GalleryService.AllowedFormats()
+	data.UploadAccept = uploadAccept(formats)
+	for i, f := range formats {
+		if i > 0 {
+			data.UploadFormats += ", "
+		}
+		data.UploadFormats += f.Name
+	}
 
 	images, err := g.GalleryService.Images(gallery.ID)
 	if err != nil {
@@ -143,25 +227,49 @@ func (g Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for _, img := range images {
-		data.Images = append(data.Images, Image{
-			GalleryID:       img.GalleryID,
-			Filename:        img.Filename,
-			FilenameEscaped: url.PathEscape(img.Filename),
-		})
+		data.Images = append(data.Images, newGalleryImage(galleryPath(gallery), img))
 	}
 
-	g.Templates.Edit.Execute(w, r, data)
+	links, err := g.ShareLinkService.ByGalleryID(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something Went Wrong", http.StatusInternalServerError)
+		return
+	}
+
+	for _, link := range links {
+		sl := ShareLink{
+			ID:        link.ID,
+			CreatedAt: link.CreatedAt.Format(time.DateTime),
+			Expired:   link.Expired(),
+			Protected: link.HasPassword(),
+			Views:     link.ViewCount,
+		}
+		if !link.ExpiresAt.IsZero() {
+			sl.ExpiresAt = link.ExpiresAt.Format(time.DateTime)
+		}
+		data.ShareLinks = append(data.ShareLinks, sl)
+	}
+
+	g.Templates.Edit.Execute(w, r, data, errs...)
 }
 
 func (g Galleries) Update(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
 	if err != nil {
-		http.Error(w, "Something Went Wrong", http.StatusInternalServerError)
 		return
 	}
 
 	gallery.Title = r.FormValue("title")
-	err = g.GalleryService.Update(*gallery)
+	if visibility := r.FormValue("visibility"); visibility != "" {
+		if !models.ValidVisibility(visibility) {
+			http.Error(w, "Invalid visibility", http.StatusBadRequest)
+			return
+		}
+		gallery.Visibility = visibility
+	}
+	gallery.KeepGPS = r.FormValue("keep_gps") == "true"
+	err = g.GalleryService.Update(gallery)
 
 	if err != nil {
 		http.Error(w, "Something Went Wrong", http.StatusInternalServerError)
@@ -174,7 +282,6 @@ func (g Galleries) Update(w http.ResponseWriter, r *http.Request) {
 func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
 	if err != nil {
-		http.Error(w, "Something Went Wrong", http.StatusInternalServerError)
 		return
 	}
 
@@ -189,14 +296,56 @@ func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 }
 
 func (g Galleries) Image(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userCanViewGallery)
+	if err != nil {
+		return
+	}
+	g.image(w, r, gallery)
+}
+
+// UnlistedImage serves an image of a gallery reached through its slug.
+func (g Galleries) UnlistedImage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryBySlug(w, r)
+	if err != nil {
+		return
+	}
+	g.image(w, r, gallery)
+}
+
+func (g Galleries) image(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) {
 	filename := g.filename(r)
 
-	galleryID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	image, err := g.GalleryService.Image(gallery.ID, filename)
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusNotFound)
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something Went Wrong", http.StatusInternalServerError)
 		return
 	}
-	image, err := g.GalleryService.Image(galleryID, filename)
+
+	size := r.URL.Query().Get("size")
+	if !models.ValidSize(size) && size != "" {
+		http.Error(w, "Invalid size", http.StatusBadRequest)
+		return
+	}
+
+	g.serveImage(w, r, image, size)
+}
+
+// serveImage writes the image contents from storage. Seekable objects go
+// through http.ServeContent so range and conditional requests keep working.
+// Images with a fallback format are served in it to clients whose Accept
+// header does not list the image's own format.
+func (g Galleries) serveImage(w http.ResponseWriter, r *http.Request, image models.Image, size string) {
+	if image.HasFallback() {
+		w.Header().Add("Vary", "Accept")
+	}
+	rc, info, err := g.GalleryService.OpenRendition(image, size, func(contentType string) bool {
+		return acceptsImage(r, contentType)
+	})
 	if err != nil {
 		if errors.Is(err, models.ErrNotFound) {
 			http.Error(w, "Image not found", http.StatusNotFound)
@@ -206,14 +355,58 @@ func (g Galleries) Image(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Something Went Wrong", http.StatusInternalServerError)
 		return
 	}
+	defer rc.Close()
 
-	http.ServeFile(w, r, image.Path)
+	w.Header().Set("Content-Type", info.ContentType)
+	if rs, ok := rc.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, image.Filename, info.ModTime, rs)
+		return
+	}
+	if info.Size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	}
+	if !info.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	}
+	io.Copy(w, rc)
+}
+
+// acceptsImage reports whether the Accept header of r allows contentType.
+// Browsers send image/* or */* even for formats they cannot display, so
+// wildcards only count when no image type is listed explicitly.
+func acceptsImage(r *http.Request, contentType string) bool {
+	header := r.Header.Get("Accept")
+	if header == "" {
+		return true
+	}
+	listed := false
+	wildcard := false
+	for _, item := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(item)
+		if err != nil {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q <= 0 {
+			if mediaType == contentType {
+				return false
+			}
+			continue
+		}
+		switch {
+		case mediaType == contentType:
+			return true
+		case mediaType == "*/*" || mediaType == "image/*":
+			wildcard = true
+		case strings.HasPrefix(mediaType, "image/"):
+			listed = true
+		}
+	}
+	return wildcard && !listed
 }
 
 func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusNotFound)
 		return
 	}
 
@@ -226,38 +419,113 @@ func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
 
 	fileHeaders := r.MultipartForm.File["images"]
 
+	var notice editNotice
 	for _, filHeader := range fileHeaders {
+		if isZip(filHeader.Filename) {
+			results, err := g.importZip(gallery.ID, filHeader)
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "Something Went Wrong", http.StatusInternalServerError)
+				return
+			}
+			notice.Uploads = append(notice.Uploads, results...)
+			continue
+		}
+
 		file, err := filHeader.Open()
 		if err != nil {
 			http.Error(w, "Something Went Wrong", http.StatusInternalServerError)
 			return
 		}
 		defer file.Close()
-		err = g.GalleryService.CreateImage(gallery.ID, filHeader.Filename, file)
+		_, err = g.GalleryService.CreateImage(gallery.ID, filHeader.Filename, file)
 		if err != nil {
 			var fileErr models.FileError
 			if errors.As(err, &fileErr) {
-				msg := fmt.Sprintf("%v has an invalid content type or extension. Only png, jpg, jpeg, gif files are allowed.", filHeader.Filename)
+				msg := fmt.Sprintf("%v could not be uploaded: %v", filHeader.Filename, fileErr.Issue)
 				http.Error(w, msg, http.StatusBadRequest)
 				return
 			}
+			if errors.Is(err, models.ErrImageExists) {
+				msg := fmt.Sprintf("An image named %v already exists in this gallery.", filHeader.Filename)
+				http.Error(w, msg, http.StatusConflict)
+				return
+			}
 			http.Error(w, "Something Went Wrong", http.StatusInternalServerError)
 			return
 		}
 	}
 
+	// Archives can partly fail, so show what happened to each file rather
+	// than redirecting.
+	if notice.Uploads != nil {
+		g.renderEdit(w, r, gallery, notice)
+		return
+	}
+
 	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
 
 	http.Redirect(w, r, editPath, http.StatusFound)
 
 }
 
+// importZip unpacks an uploaded zip archive into a gallery and describes the
+// outcome of every file in it.
+func (g Galleries) importZip(galleryID int, fileHeader *multipart.FileHeader) ([]uploadResult, error) {
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, fmt.Errorf("import zip: %w", err)
+	}
+	defer file.Close()
+
+	results, err := g.GalleryService.ImportZip(galleryID, file, fileHeader.Size)
+	var fileErr models.FileError
+	if errors.As(err, &fileErr) {
+		// Entries before the archive was rejected may have been imported.
+		uploads := newUploadResults(results)
+		return append(uploads, uploadResult{Name: fileHeader.Filename, Error: fileErr.Issue}), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return []uploadResult{{Name: fileHeader.Filename, Error: "archive has no files"}}, nil
+	}
+	return newUploadResults(results), nil
+}
+
+func newUploadResults(results []models.ImportResult) []uploadResult {
+	uploads := make([]uploadResult, 0, len(results))
+	for _, result := range results {
+		upload := uploadResult{Name: result.Name}
+		if result.Filename != "" && result.Filename != models.DisplayName(result.Name) {
+			upload.SavedAs = result.Filename
+		}
+		if result.Err != nil {
+			var fileErr models.FileError
+			if errors.As(result.Err, &fileErr) {
+				upload.Error = fileErr.Issue
+			} else if errors.Is(result.Err, models.ErrImageExists) {
+				upload.Error = "an image with this name already exists"
+			} else {
+				fmt.Println(result.Err)
+				upload.Error = "could not be saved"
+			}
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads
+}
+
+func isZip(filename string) bool {
+	return strings.EqualFold(filepath.Ext(filename), ".zip")
+}
+
 func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
 	filename := g.filename(r)
 
 	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusNotFound)
 		return
 	}
 	err = g.GalleryService.DeleteImage(gallery.ID, filename)
@@ -276,6 +544,122 @@ func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, editPath, http.StatusFound)
 }
 
+// uploadAccept is the accept attribute of the upload form. Phones convert
+// photos to a listed format when theirs, usually HEIC, is not.
+func uploadAccept(formats []imaging.Format) string {
+	var accept []string
+	for _, f := range formats {
+		accept = append(accept, f.ContentType)
+		accept = append(accept, f.Extensions...)
+	}
+	accept = append(accept, ".zip", "application/zip")
+	return strings.Join(accept, ", ")
+}
+
+// galleryImage is the template data for an image shown in a gallery.
+type galleryImage struct {
+	GalleryID       int
+	Filename        string
+	DisplayName     string
+	FilenameEscaped string
+	// Href links to the original, Src and SrcSet feed a responsive <img>.
+	Href   string
+	Src    string
+	SrcSet string
+	Width  int
+	Height int
+	// Metadata is only loaded for the show page.
+	Metadata *imageMetadata
+}
+
+// imageMetadata is the camera information shown with a photo.
+type imageMetadata struct {
+	Camera   string
+	Lens     string
+	Exposure string
+	TakenAt  string
+	MapURL   string
+}
+
+// newImageMetadata formats the EXIF of an image for display, or returns nil
+// when there is nothing to show.
+func newImageMetadata(x *imaging.EXIF) *imageMetadata {
+	if x == nil {
+		return nil
+	}
+	var m imageMetadata
+	m.Camera = x.Model
+	if x.Make != "" && !strings.HasPrefix(strings.ToLower(x.Model), strings.ToLower(x.Make)) {
+		m.Camera = strings.TrimSpace(x.Make + " " + x.Model)
+	}
+	m.Lens = x.LensModel
+
+	var exposure []string
+	if x.ExposureTime != "" {
+		exposure = append(exposure, x.ExposureTime+"s")
+	}
+	if x.FNumber > 0 {
+		exposure = append(exposure, "f/"+strconv.FormatFloat(x.FNumber, 'f', -1, 64))
+	}
+	if x.ISO > 0 {
+		exposure = append(exposure, fmt.Sprintf("ISO %d", x.ISO))
+	}
+	if x.FocalLength > 0 {
+		exposure = append(exposure, strconv.FormatFloat(x.FocalLength, 'f', -1, 64)+"mm")
+	}
+	m.Exposure = strings.Join(exposure, " · ")
+
+	if !x.TakenAt.IsZero() {
+		m.TakenAt = x.TakenAt.Format(time.DateTime)
+	}
+	if x.GPS != nil {
+		q := url.Values{}
+		q.Set("mlat", strconv.FormatFloat(x.GPS.Latitude, 'f', 6, 64))
+		q.Set("mlon", strconv.FormatFloat(x.GPS.Longitude, 'f', 6, 64))
+		m.MapURL = "https://www.openstreetmap.org/?" + q.Encode()
+	}
+
+	if m == (imageMetadata{}) {
+		return nil
+	}
+	return &m
+}
+
+// newGalleryImage builds the template data for img. basePath is the gallery
+// URL the image is served below.
+func newGalleryImage(basePath string, img models.Image) galleryImage {
+	escaped := url.PathEscape(img.Filename)
+	href := basePath + "/images/" + escaped
+
+	gi := galleryImage{
+		GalleryID:       img.GalleryID,
+		Filename:        img.Filename,
+		DisplayName:     img.DisplayName,
+		FilenameEscaped: escaped,
+		Href:            href,
+		Src:             href,
+		Width:           img.Width,
+		Height:          img.Height,
+	}
+
+	var srcset []string
+	for _, rendition := range img.Renditions() {
+		src := href
+		if rendition.Size != models.SizeOriginal {
+			src += "?size=" + rendition.Size
+		}
+		if rendition.Size == models.SizeThumb {
+			gi.Src = src
+		}
+		if rendition.Width > 0 {
+			srcset = append(srcset, fmt.Sprintf("%s %dw", src, rendition.Width))
+		}
+	}
+	gi.SrcSet = strings.Join(srcset, ", ")
+
+	return gi
+}
+
 type galleryOpt func(http.ResponseWriter, *http.Request, *models.Gallery) error
 
 func (g Galleries) filename(r *http.Request) string {
@@ -296,16 +680,47 @@ func (g Galleries) galleryByID(w http.ResponseWriter, r *http.Request, opts ...g
 	if err != nil {
 		if errors.Is(err, models.ErrNotFound) {
 			http.Error(w, "Gallery Not Found", http.StatusNotFound)
+			return nil, err
+		}
+		http.Error(w, "Something Went Wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+
+	// Options write their own response when they reject the request.
+	for _, opt := range opts {
+		err = opt(w, r, gallery)
+		if err != nil {
+			return nil, err
+		}
+	}
 
+	return gallery, nil
+}
+
+// galleryBySlug loads an unlisted or public gallery by its slug. Private
+// galleries are only visible to their owner.
+func (g Galleries) galleryBySlug(w http.ResponseWriter, r *http.Request, opts ...galleryOpt) (*models.Gallery, error) {
+	gallery, err := g.GalleryService.BySlug(chi.URLParam(r, "slug"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Gallery Not Found", http.StatusNotFound)
+			return nil, err
 		}
 		http.Error(w, "Something Went Wrong", http.StatusInternalServerError)
 		return nil, err
 	}
 
+	if gallery.Visibility == models.VisibilityPrivate {
+		user := context.User(r.Context())
+		if user == nil || user.ID != gallery.UserID {
+			http.Error(w, "Gallery Not Found", http.StatusNotFound)
+			return nil, fmt.Errorf("gallery is private")
+		}
+	}
+
 	for _, opt := range opts {
 		err = opt(w, r, gallery)
 		if err != nil {
-			http.Error(w, "Something Went Wrong", http.StatusInternalServerError)
 			return nil, err
 		}
 	}
@@ -316,10 +731,33 @@ func (g Galleries) galleryByID(w http.ResponseWriter, r *http.Request, opts ...g
 func userMustOwnGallery(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
 	user := context.User(r.Context())
 
-	if gallery.UserID != user.ID {
+	if user == nil || gallery.UserID != user.ID {
 		http.Error(w, "You are not authorized to edit this gallery", http.StatusForbidden)
 		return fmt.Errorf("user doesnt have access to this gallery")
 	}
 
 	return nil
 }
+
+// userCanViewGallery allows public galleries and the owner. Unlisted galleries
+// are only reachable through their slug, so they are reported as missing here
+// just like private ones.
+func userCanViewGallery(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+	if gallery.Visibility == models.VisibilityPublic {
+		return nil
+	}
+	user := context.User(r.Context())
+	if user != nil && gallery.UserID == user.ID {
+		return nil
+	}
+	http.Error(w, "Gallery Not Found", http.StatusNotFound)
+	return fmt.Errorf("user cannot view this gallery")
+}
+
+func galleryPath(gallery *models.Gallery) string {
+	return fmt.Sprintf("/galleries/%d", gallery.ID)
+}
+
+func unlistedPath(gallery *models.Gallery) string {
+	return "/g/" + url.PathEscape(gallery.Slug)
+}
@@ -0,0 +1,179 @@
+package controllers
+
+import (
+	"example/web-go/errors"
+	"example/web-go/models"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	CookieShareUnlock = "share_unlock"
+)
+
+// shareLinkDurations are the expiry choices offered on the edit page.
+var shareLinkDurations = map[string]time.Duration{
+	"1d":  24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+}
+
+func (g Galleries) CreateShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	var expiresAt time.Time
+	if expires := r.FormValue("expires"); expires != "" && expires != "never" {
+		duration, ok := shareLinkDurations[expires]
+		if !ok {
+			http.Error(w, "Invalid expiry", http.StatusBadRequest)
+			return
+		}
+		expiresAt = time.Now().Add(duration)
+	}
+
+	link, err := g.ShareLinkService.Create(gallery.ID, r.FormValue("password"), expiresAt)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something Went Wrong", http.StatusInternalServerError)
+		return
+	}
+
+	g.renderEdit(w, r, gallery, editNotice{
+		ShareURL: absoluteURL(r, sharePath(link.Token)),
+	})
+}
+
+func (g Galleries) DeleteShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	linkID, err := strconv.Atoi(chi.URLParam(r, "linkID"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+
+	err = g.ShareLinkService.Delete(gallery.ID, linkID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Share link not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something Went Wrong", http.StatusInternalServerError)
+		return
+	}
+
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// ShowShared renders the gallery behind a share link, asking for the link
+// password first when it has one.
+func (g Galleries) ShowShared(w http.ResponseWriter, r *http.Request) {
+	link, err := g.shareLink(w, r)
+	if err != nil {
+		return
+	}
+	if !g.shareUnlocked(r, link) {
+		g.Templates.SharePassword.Execute(w, r, nil)
+		return
+	}
+
+	gallery, err := g.GalleryService.ByID(link.GalleryID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something Went Wrong", http.StatusInternalServerError)
+		return
+	}
+
+	err = g.ShareLinkService.RecordView(link.ID)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	g.renderShow(w, r, gallery, sharePath(chi.URLParam(r, "token")))
+}
+
+func (g Galleries) UnlockShared(w http.ResponseWriter, r *http.Request) {
+	link, err := g.shareLink(w, r)
+	if err != nil {
+		return
+	}
+
+	allowed, retryAfter := g.UnlockThrottle.allow(r, strconv.Itoa(link.ID))
+	if !allowed {
+		tooManyRequests(w, r, g.Templates.SharePassword, retryAfter, nil)
+		return
+	}
+
+	if !g.ShareLinkService.CheckPassword(link, r.FormValue("password")) {
+		err = errors.Public(fmt.Errorf("share link: wrong password"), "The password is incorrect.")
+		g.Templates.SharePassword.Execute(w, r, nil, err)
+		return
+	}
+
+	path := sharePath(chi.URLParam(r, "token"))
+	cookie := newCookie(CookieShareUnlock, g.ShareLinkService.UnlockKey(link))
+	cookie.Path = path
+	http.SetCookie(w, cookie)
+	http.Redirect(w, r, path, http.StatusFound)
+}
+
+func (g Galleries) SharedImage(w http.ResponseWriter, r *http.Request) {
+	link, err := g.shareLink(w, r)
+	if err != nil {
+		return
+	}
+	if !g.shareUnlocked(r, link) {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	gallery, err := g.GalleryService.ByID(link.GalleryID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something Went Wrong", http.StatusInternalServerError)
+		return
+	}
+	g.image(w, r, gallery)
+}
+
+func (g Galleries) shareLink(w http.ResponseWriter, r *http.Request) (*models.ShareLink, error) {
+	link, err := g.ShareLinkService.ByToken(chi.URLParam(r, "token"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "This link is invalid or has expired", http.StatusNotFound)
+			return nil, err
+		}
+		fmt.Println(err)
+		http.Error(w, "Something Went Wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+	return link, nil
+}
+
+func (g Galleries) shareUnlocked(r *http.Request, link *models.ShareLink) bool {
+	if !link.HasPassword() {
+		return true
+	}
+	key, err := readCookie(r, CookieShareUnlock)
+	if err != nil {
+		return false
+	}
+	return key == g.ShareLinkService.UnlockKey(link)
+}
+
+func sharePath(token string) string {
+	return "/s/" + url.PathEscape(token)
+}
@@ -0,0 +1,69 @@
+package controllers
+
+import (
+	"example/web-go/errors"
+	"example/web-go/throttle"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Throttle limits attempts at an action per client IP and per target of the
+// action, such as the email address signed in to or the share link unlocked.
+// A nil limiter is not applied.
+type Throttle struct {
+	PerIP     *throttle.Limiter
+	PerTarget *throttle.Limiter
+}
+
+// allow records an attempt and reports whether it may go ahead, and if not
+// when to retry. Store errors are logged and let the attempt through; an
+// unavailable store should not lock everybody out.
+func (t *Throttle) allow(r *http.Request, target string) (bool, time.Duration) {
+	if t == nil {
+		return true, 0
+	}
+	var retryAfter time.Duration
+	allowed := true
+	check := func(l *throttle.Limiter, key string) {
+		if l == nil || key == "" {
+			return
+		}
+		ok, wait, err := l.Allow(key)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if !ok {
+			allowed = false
+			retryAfter = max(retryAfter, wait)
+		}
+	}
+	check(t.PerIP, clientIP(r))
+	check(t.PerTarget, target)
+	return allowed, retryAfter
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// tooManyRequests renders tpl with a 429 status and a Retry-After header. The
+// header and status have to be written before the template renders the body.
+func tooManyRequests(w http.ResponseWriter, r *http.Request, tpl Template, retryAfter time.Duration, data interface{}) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	minutes := (seconds + 59) / 60
+	msg := "Too many attempts. Please try again in a minute."
+	if minutes > 1 {
+		msg = fmt.Sprintf("Too many attempts. Please try again in %d minutes.", minutes)
+	}
+	err := errors.Public(fmt.Errorf("throttled for %v", retryAfter), msg)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusTooManyRequests)
+	tpl.Execute(w, r, data, err)
+}
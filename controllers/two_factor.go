@@ -0,0 +1,169 @@
+package controllers
+
+import (
+	"example/web-go/context"
+	"example/web-go/errors"
+	"example/web-go/models"
+	"fmt"
+	"html/template"
+	"net/http"
+)
+
+func (u User) SignInTwoFactor(w http.ResponseWriter, r *http.Request) {
+	_, err := readCookie(r, CookiePendingAuth)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	u.Templates.TwoFactor.Execute(w, r, nil)
+}
+
+func (u User) ProcessSignInTwoFactor(w http.ResponseWriter, r *http.Request) {
+	token, err := readCookie(r, CookiePendingAuth)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	user, err := u.PendingAuthService.User(token)
+	if err != nil {
+		if !errors.Is(err, models.ErrNotFound) {
+			fmt.Println(err)
+		}
+		// Expired or too many attempts; start over from the password.
+		deleteCookie(w, CookiePendingAuth)
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+
+	err = u.TwoFactorService.Verify(user.ID, r.FormValue("code"))
+	if err != nil {
+		if !errors.Is(err, models.ErrInvalidCode) {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		err = u.PendingAuthService.Fail(token)
+		if err != nil {
+			fmt.Println(err)
+		}
+		err = errors.Public(models.ErrInvalidCode, "The code is incorrect.")
+		u.Templates.TwoFactor.Execute(w, r, nil, err)
+		return
+	}
+
+	err = u.PendingAuthService.Delete(token)
+	if err != nil {
+		fmt.Println(err)
+	}
+	deleteCookie(w, CookiePendingAuth)
+	u.signIn(w, r, user)
+}
+
+func (u User) Security(w http.ResponseWriter, r *http.Request) {
+	u.renderSecurity(w, r, nil)
+}
+
+func (u User) BeginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	_, err := u.TwoFactorService.Begin(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.renderSecurity(w, r, nil)
+}
+
+func (u User) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	codes, err := u.TwoFactorService.Confirm(user.ID, r.FormValue("code"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCode) {
+			err = errors.Public(err, "The code is incorrect. Check the time on your device and try again.")
+			u.renderSecurity(w, r, nil, err)
+			return
+		}
+		if errors.Is(err, models.ErrNotFound) {
+			http.Redirect(w, r, "/users/me/security", http.StatusFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.renderSecurity(w, r, codes)
+}
+
+func (u User) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if !u.verifyTwoFactor(w, r, user) {
+		return
+	}
+	err := u.TwoFactorService.Disable(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/security", http.StatusFound)
+}
+
+func (u User) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if !u.verifyTwoFactor(w, r, user) {
+		return
+	}
+	codes, err := u.TwoFactorService.RegenerateRecoveryCodes(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.renderSecurity(w, r, codes)
+}
+
+// verifyTwoFactor checks the code submitted with changes to an enabled second
+// factor. It renders the security page with an error and returns false if the
+// code is wrong.
+func (u User) verifyTwoFactor(w http.ResponseWriter, r *http.Request, user *models.User) bool {
+	err := u.TwoFactorService.Verify(user.ID, r.FormValue("code"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCode) || errors.Is(err, models.ErrNotFound) {
+			err = errors.Public(err, "The code is incorrect.")
+			u.renderSecurity(w, r, nil, err)
+			return false
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// renderSecurity shows the two-factor settings. recoveryCodes are only passed
+// right after they were generated; they cannot be shown again.
+func (u User) renderSecurity(w http.ResponseWriter, r *http.Request, recoveryCodes []string, errs ...error) {
+	var data struct {
+		Enabled           bool
+		Secret            string
+		URI               template.URL
+		RecoveryCodesLeft int
+		RecoveryCodes     []string
+	}
+	user := context.User(r.Context())
+	status, err := u.TwoFactorService.Status(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Enabled = status.Enabled
+	data.RecoveryCodesLeft = status.RecoveryCodesLeft
+	data.RecoveryCodes = recoveryCodes
+	if status.PendingSecret != "" {
+		data.Secret = status.PendingSecret
+		// html/template rejects the otpauth scheme; the URI is built by us.
+		data.URI = template.URL(u.TwoFactorService.URI(user.Email, status.PendingSecret))
+	}
+	u.Templates.Security.Execute(w, r, data, errs...)
+}
@@ -0,0 +1,194 @@
+package controllers
+
+import (
+	"example/web-go/errors"
+	"example/web-go/models"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Resumable uploads let a client send a large image in chunks and pick up
+// where it left off after a dropped connection:
+//
+//  1. POST /galleries/{id}/uploads with {"filename": ..., "size": ...}
+//     starts an upload and returns its URL.
+//  2. PATCH the upload URL with a chunk of the file as an
+//     application/offset+octet-stream body and the position of its first
+//     byte in the Upload-Offset header. The response carries the new offset.
+//  3. After a failure, HEAD the upload URL to learn the offset to resume at.
+//
+// The image is created by the PATCH that delivers the last byte.
+
+// DefaultMaxChunkSize caps the body of a single PATCH request.
+const DefaultMaxChunkSize = 8 << 20
+
+const uploadChunkType = "application/offset+octet-stream"
+
+type apiUpload struct {
+	ID        int       `json:"id"`
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	Offset    int64     `json:"offset"`
+	ExpiresAt time.Time `json:"expires_at"`
+	URL       string    `json:"url"`
+}
+
+func newAPIUpload(upload *models.UploadSession) apiUpload {
+	return apiUpload{
+		ID:        upload.ID,
+		Filename:  upload.Filename,
+		Size:      upload.Size,
+		Offset:    upload.Offset,
+		ExpiresAt: upload.ExpiresAt,
+		URL:       fmt.Sprintf("/api/v1/galleries/%d/uploads/%d", upload.GalleryID, upload.ID),
+	}
+}
+
+func (a API) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, true)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var req struct {
+		Filename string `json:"filename"`
+		Size     int64  `json:"size"`
+	}
+	err = readJSON(r, &req)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if req.Filename == "" {
+		writeAPIError(w, apiError{http.StatusBadRequest, "invalid_request", "filename is required."})
+		return
+	}
+
+	upload, err := a.UploadSessionService.Create(gallery.ID, req.Filename, req.Size)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	resp := newAPIUpload(upload)
+	w.Header().Set("Location", resp.URL)
+	setUploadHeaders(w, upload)
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// Upload reports the progress of an upload. Clients resume from the offset
+// it returns; HEAD requests get the same headers without a body.
+func (a API) Upload(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, true)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "uploadID"))
+	if err != nil {
+		writeAPIError(w, errAPINotFound)
+		return
+	}
+	upload, err := a.UploadSessionService.ByID(gallery.ID, id)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	setUploadHeaders(w, upload)
+	writeJSON(w, http.StatusOK, newAPIUpload(upload))
+}
+
+func (a API) AppendUpload(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, true)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "uploadID"))
+	if err != nil {
+		writeAPIError(w, errAPINotFound)
+		return
+	}
+	if r.Header.Get("Content-Type") != uploadChunkType {
+		writeAPIError(w, apiError{http.StatusUnsupportedMediaType, "invalid_request", "Chunks must be sent as " + uploadChunkType + "."})
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeAPIError(w, apiError{http.StatusBadRequest, "invalid_request", "Upload-Offset header is required."})
+		return
+	}
+
+	// Keep whatever arrived before a dropped connection; the client resumes
+	// after it instead of resending the whole chunk.
+	chunk, err := io.ReadAll(http.MaxBytesReader(w, r.Body, a.maxChunkSize()))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeAPIError(w, apiError{http.StatusRequestEntityTooLarge, "chunk_too_large",
+				fmt.Sprintf("Chunks may be at most %d bytes.", a.maxChunkSize())})
+			return
+		}
+		fmt.Println(err)
+	}
+
+	upload, err := a.UploadSessionService.Append(gallery.ID, id, offset, chunk)
+	if err != nil {
+		var offsetErr models.UploadOffsetError
+		if errors.As(err, &offsetErr) {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(offsetErr.Offset, 10))
+		}
+		writeAPIError(w, err)
+		return
+	}
+	setUploadHeaders(w, upload)
+	if !upload.Finishing {
+		writeJSON(w, http.StatusOK, newAPIUpload(upload))
+		return
+	}
+
+	image, err := a.UploadSessionService.Finish(upload)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newAPIImage(gallery, image))
+}
+
+func (a API) DeleteUpload(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, true)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "uploadID"))
+	if err != nil {
+		writeAPIError(w, errAPINotFound)
+		return
+	}
+	err = a.UploadSessionService.Delete(gallery.ID, id)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func setUploadHeaders(w http.ResponseWriter, upload *models.UploadSession) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+}
+
+func (a API) maxChunkSize() int64 {
+	if a.MaxChunkSize == 0 {
+		return DefaultMaxChunkSize
+	}
+	return a.MaxChunkSize
+}
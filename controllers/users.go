@@ -4,9 +4,15 @@ import (
 	"example/web-go/context"
 	"example/web-go/errors"
 	"example/web-go/models"
+	"example/web-go/password"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
 )
 
 type User struct {
@@ -16,11 +22,31 @@ type User struct {
 		ForgotPassword Template
 		CheckYourEmail Template
 		ResetPassword  Template
+		Sessions       Template
+		APITokens      Template
+		VerifyEmail    Template
+		TwoFactor      Template
+		Security       Template
+		Account        Template
+		EmailChanged   Template
 	}
 	UserService          *models.UserService
 	SessionService       *models.SessionService
+	APITokenService      *models.APITokenService
 	PasswordResetService *models.PasswordResetService
 	EmailService         *models.EmailService
+
+	EmailVerificationService *models.EmailVerificationService
+	TwoFactorService         *models.TwoFactorService
+	PendingAuthService       *models.PendingAuthService
+	EmailChangeService       *models.EmailChangeService
+	AccountDeletionService   *models.AccountDeletionService
+	GalleryService           *models.GalleryService
+
+	// SignInThrottle and ForgotPasswordThrottle may be nil to allow
+	// unlimited attempts.
+	SignInThrottle         *Throttle
+	ForgotPasswordThrottle *Throttle
 }
 
 func (u User) New(w http.ResponseWriter, r *http.Request) {
@@ -44,14 +70,25 @@ func (u User) Create(w http.ResponseWriter, r *http.Request) {
 	user, err := u.UserService.Create(data.Email, data.Password)
 
 	if err != nil {
-		if errors.Is(err, models.ErrEmailTaken) {
+		var pwErr password.Error
+		switch {
+		case errors.Is(err, models.ErrEmailTaken):
 			err = errors.Public(err, "Email is already in use.")
+		case errors.As(err, &pwErr):
+			err = errors.Public(err, pwErr.Issue)
 		}
 		u.Templates.New.Execute(w, r, data, err)
 		return
 	}
 
-	session, err := u.SessionService.Create(user.ID)
+	// A failed mail should not fail the sign up; the user can ask for
+	// another one.
+	err = u.sendVerification(r, user)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	session, err := u.SessionService.Create(user.ID, r.UserAgent(), clientIP(r))
 	if err != nil {
 		fmt.Println(err)
 		// TODO improve this.
@@ -59,7 +96,7 @@ func (u User) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	setCookie(w, CookieSession, session.Token)
+	setCookieExpires(w, CookieSession, session.Token, session.IdleExpiresAt)
 
 	http.Redirect(w, r, "/galleries", http.StatusFound)
 }
@@ -77,26 +114,312 @@ func (u User) ProcessSignIn(w http.ResponseWriter, r *http.Request) {
 	email := r.FormValue("email")
 	password := r.FormValue("password")
 
+	var data struct {
+		Email string
+	}
+	data.Email = email
+
+	allowed, retryAfter := u.SignInThrottle.allow(r, normalizeEmail(email))
+	if !allowed {
+		tooManyRequests(w, r, u.Templates.SignIn, retryAfter, data)
+		return
+	}
+
 	user, err := u.UserService.Authenticate(email, password)
 
+	if err != nil {
+		var locked models.LockedError
+		if errors.As(err, &locked) {
+			tooManyRequests(w, r, u.Templates.SignIn, time.Until(locked.Until), data)
+			return
+		}
+		if errors.Is(err, models.ErrInvalidCredentials) {
+			err = errors.Public(err, "Invalid email or password.")
+		}
+		u.Templates.SignIn.Execute(w, r, data, err)
+		return
+	}
+
+	u.completeSignIn(w, r, user)
+}
+
+// completeSignIn asks for the second factor if user has one and otherwise
+// signs them in.
+func (u User) completeSignIn(w http.ResponseWriter, r *http.Request, user *models.User) {
+	if user.TOTPEnabled {
+		pending, err := u.PendingAuthService.Create(user.ID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		setCookieExpires(w, CookiePendingAuth, pending.Token, pending.ExpiresAt)
+		http.Redirect(w, r, "/signin/2fa", http.StatusFound)
+		return
+	}
+
+	u.signIn(w, r, user)
+}
+
+// signIn starts a session for user once every sign in step has passed.
+func (u User) signIn(w http.ResponseWriter, r *http.Request, user *models.User) {
+	session, err := u.SessionService.Create(user.ID, r.UserAgent(), clientIP(r))
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
+	setCookieExpires(w, CookieSession, session.Token, session.IdleExpiresAt)
+	http.Redirect(w, r, "/galleries/", http.StatusFound)
+}
+
+func (u User) Sessions(w http.ResponseWriter, r *http.Request) {
+	type Session struct {
+		ID         int
+		UserAgent  string
+		IPAddress  string
+		CreatedAt  string
+		LastSeenAt string
+		Current    bool
+	}
+	var data struct {
+		Sessions []Session
+	}
 
-	session, err := u.SessionService.Create(user.ID)
+	user := context.User(r.Context())
+	token, err := readCookie(r, CookieSession)
 	if err != nil {
 		fmt.Println(err)
+		http.Redirect(w, r, "/signin", http.StatusFound)
 		return
 	}
-	setCookie(w, CookieSession, session.Token)
-	http.Redirect(w, r, "/galleries/", http.StatusFound)
+
+	sessions, err := u.SessionService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	for _, session := range sessions {
+		data.Sessions = append(data.Sessions, Session{
+			ID:         session.ID,
+			UserAgent:  session.UserAgent,
+			IPAddress:  session.IPAddress,
+			CreatedAt:  session.CreatedAt.Format(time.DateTime),
+			LastSeenAt: session.LastSeenAt.Format(time.DateTime),
+			Current:    session.Matches(token),
+		})
+	}
+
+	u.Templates.Sessions.Execute(w, r, data)
+}
+
+func (u User) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+
+	err = u.SessionService.DeleteByID(user.ID, id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/users/me/sessions", http.StatusFound)
+}
+
+func (u User) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	token, err := readCookie(r, CookieSession)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+
+	err = u.SessionService.DeleteOthers(user.ID, token)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/users/me/sessions", http.StatusFound)
+}
+
+func (u User) APITokens(w http.ResponseWriter, r *http.Request) {
+	u.renderAPITokens(w, r, nil)
+}
+
+func (u User) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(r.PostForm.Get("name"))
+	if name == "" {
+		err = errors.Public(fmt.Errorf("create api token: missing name"), "Token name is required.")
+		u.renderAPITokens(w, r, nil, err)
+		return
+	}
+	scopes := r.PostForm["scope"]
+	if len(scopes) == 0 {
+		err = errors.Public(fmt.Errorf("create api token: no scopes"), "Select at least one scope.")
+		u.renderAPITokens(w, r, nil, err)
+		return
+	}
+
+	token, err := u.APITokenService.Create(user.ID, name, scopes)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	// The token is only ever shown here; we keep nothing but its hash.
+	u.renderAPITokens(w, r, token)
+}
+
+func (u User) RevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+
+	err = u.APITokenService.Delete(user.ID, id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/users/me/tokens", http.StatusFound)
 }
 
-func (u User) CurrentUser(w http.ResponseWriter, r *http.Request) {
+func (u User) renderAPITokens(w http.ResponseWriter, r *http.Request, newToken *models.APIToken, errs ...error) {
+	type Token struct {
+		ID         int
+		Name       string
+		Scopes     string
+		CreatedAt  string
+		LastUsedAt string
+	}
+	var data struct {
+		Tokens   []Token
+		Scopes   []string
+		NewToken *models.APIToken
+	}
+	data.Scopes = models.Scopes
+	data.NewToken = newToken
+
 	user := context.User(r.Context())
-	fmt.Fprintf(w, "Current user: %s\n", user.Email)
+	tokens, err := u.APITokenService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	for _, token := range tokens {
+		lastUsed := "Never"
+		if !token.LastUsedAt.IsZero() {
+			lastUsed = token.LastUsedAt.Format(time.DateTime)
+		}
+		data.Tokens = append(data.Tokens, Token{
+			ID:         token.ID,
+			Name:       token.Name,
+			Scopes:     strings.Join(token.Scopes, ", "),
+			CreatedAt:  token.CreatedAt.Format(time.DateTime),
+			LastUsedAt: lastUsed,
+		})
+	}
+
+	u.Templates.APITokens.Execute(w, r, data, errs...)
+}
+
+// VerifyEmail consumes the token from a verification mail. Without a token it
+// shows the verification status of the current user.
+func (u User) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Verified bool
+		Sent     bool
+	}
+	user := context.User(r.Context())
+	data.Verified = user != nil && user.Verified()
+
+	token := r.FormValue("token")
+	if token == "" {
+		u.Templates.VerifyEmail.Execute(w, r, data)
+		return
+	}
+
+	_, err := u.EmailVerificationService.Consume(token)
+	if err != nil {
+		if errors.Is(err, models.ErrTokenInvalid) || errors.Is(err, models.ErrTokenExpired) {
+			err = errors.Public(err, "This verification link is invalid or has expired.")
+		}
+		u.Templates.VerifyEmail.Execute(w, r, data, err)
+		return
+	}
+
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+func (u User) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Verified bool
+		Sent     bool
+	}
+	user := context.User(r.Context())
+	if user.Verified() {
+		http.Redirect(w, r, "/verify-email", http.StatusFound)
+		return
+	}
+
+	err := u.sendVerification(r, user)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	data.Sent = true
+	u.Templates.VerifyEmail.Execute(w, r, data)
+}
+
+func (u User) sendVerification(r *http.Request, user *models.User) error {
+	verification, err := u.EmailVerificationService.Create(user.ID)
+	if err != nil {
+		return fmt.Errorf("send verification: %w", err)
+	}
+	vals := url.Values{
+		"token": {verification.Token},
+	}
+	verifyURL := absoluteURL(r, "/verify-email?"+vals.Encode())
+	err = u.EmailService.VerifyEmail(user.Email, verifyURL)
+	if err != nil {
+		return fmt.Errorf("send verification: %w", err)
+	}
+	return nil
 }
 
 func (u User) ProcessSignOut(w http.ResponseWriter, r *http.Request) {
@@ -134,8 +457,19 @@ func (u User) ProcessForgotPassword(w http.ResponseWriter, r *http.Request) {
 	}
 	data.Email = r.FormValue("email")
 
+	allowed, retryAfter := u.ForgotPasswordThrottle.allow(r, normalizeEmail(data.Email))
+	if !allowed {
+		tooManyRequests(w, r, u.Templates.ForgotPassword, retryAfter, data)
+		return
+	}
+
 	pwReset, err := u.PasswordResetService.Create(data.Email)
 	if err != nil {
+		// Do not reveal whether an account exists for the email.
+		if errors.Is(err, models.ErrNotFound) {
+			u.Templates.CheckYourEmail.Execute(w, r, data)
+			return
+		}
 		fmt.Println(err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
@@ -173,45 +507,80 @@ func (u User) ProcessResetPassword(w http.ResponseWriter, r *http.Request) {
 
 	user, err := u.PasswordResetService.Consume(data.Token)
 	if err != nil {
-		fmt.Println(err)
-		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		switch {
+		case errors.Is(err, models.ErrTokenExpired):
+			err = errors.Public(err, "This reset link has expired. Please request a new one.")
+		case errors.Is(err, models.ErrTokenInvalid):
+			err = errors.Public(err, "This reset link is invalid. Please request a new one.")
+		}
+		u.Templates.ResetPassword.Execute(w, r, data, err)
 		return
 	}
 
 	err = u.UserService.UpdatePassword(user.ID, data.Password)
 	if err != nil {
-		fmt.Println(err)
-		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		var pwErr password.Error
+		if !errors.As(err, &pwErr) {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		// The token was used up by Consume; issue a new one so the user
+		// can pick a better password without another email round trip.
+		pwReset, resetErr := u.PasswordResetService.Create(user.Email)
+		if resetErr != nil {
+			fmt.Println(resetErr)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		data.Token = pwReset.Token
+		u.Templates.ResetPassword.Execute(w, r, data, errors.Public(err, pwErr.Issue))
 		return
 	}
 
-	session, err := u.SessionService.Create(user.ID)
-	if err != nil {
-		fmt.Println(err)
-		http.Redirect(w, r, "/signin", http.StatusFound)
-	}
-	setCookie(w, CookieSession, session.Token)
-
-	http.Redirect(w, r, "/users/me", http.StatusFound)
+	// A reset proves access to the email, not to the second factor.
+	u.completeSignIn(w, r, user)
 }
 
 type UserMiddleware struct {
 	SessionService *models.SessionService
+	// RestrictUnverified makes RequireVerified turn away users who have not
+	// verified their email address. When false RequireVerified only requires
+	// a signed in user.
+	RestrictUnverified bool
 }
 
 func (umw UserMiddleware) SetUser(next http.Handler) http.Handler {
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
+			// A bearer token decides who the request acts as, so a session
+			// cookie sent alongside cannot swap in another user while the
+			// token's scopes are checked.
+			if context.APIToken(r.Context()) != nil || context.User(r.Context()) != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
 			token, err := readCookie(r, CookieSession)
 			if err != nil {
 				next.ServeHTTP(w, r)
 				return
 			}
 			user, err := umw.SessionService.User(token)
+			if err != nil {
+				if errors.Is(err, models.ErrTokenExpired) || errors.Is(err, models.ErrTokenInvalid) {
+					deleteCookie(w, CookieSession)
+				} else {
+					fmt.Println(err)
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			session, err := umw.SessionService.Touch(token)
 			if err != nil {
 				next.ServeHTTP(w, r)
 				return
 			}
+			setCookieExpires(w, CookieSession, token, session.IdleExpiresAt)
 			ctx := r.Context()
 			ctx = context.WithUser(ctx, user)
 			r = r.WithContext(ctx)
@@ -232,3 +601,22 @@ func (umw UserMiddleware) RequireUser(next http.Handler) http.Handler {
 		},
 	)
 }
+
+// RequireVerified guards actions unverified users may not take, such as
+// uploading images. It must run after RequireUser.
+func (umw UserMiddleware) RequireVerified(next http.Handler) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			user := context.User(r.Context())
+			if umw.RestrictUnverified && !user.Verified() {
+				if strings.HasPrefix(r.URL.Path, "/api/") {
+					writeAPIError(w, apiError{http.StatusForbidden, "email_unverified", "Verify your email address to do this."})
+					return
+				}
+				http.Redirect(w, r, "/verify-email", http.StatusFound)
+				return
+			}
+			next.ServeHTTP(w, r)
+		},
+	)
+}
@@ -0,0 +1,426 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoEXIF = errors.New("imaging: no exif data")
+)
+
+// EXIF holds the camera metadata of a photo. Fields the photo does not
+// record are left at their zero value.
+type EXIF struct {
+	Make      string
+	Model     string
+	LensModel string
+	// ExposureTime is in seconds, formatted the way cameras show it, e.g.
+	// "1/250" or "2".
+	ExposureTime string
+	FNumber      float64
+	ISO          int
+	// FocalLength is in millimetres.
+	FocalLength float64
+	TakenAt     time.Time
+	// Orientation is the EXIF orientation from 1 to 8; 1 is upright.
+	Orientation int
+	// GPS is nil unless the photo records where it was taken.
+	GPS *GPS
+}
+
+// GPS is a location in decimal degrees; south and west are negative.
+type GPS struct {
+	Latitude  float64
+	Longitude float64
+}
+
+const (
+	markerSOI  = 0xd8
+	markerEOI  = 0xd9
+	markerSOS  = 0xda
+	markerAPP0 = 0xe0
+	markerAPP1 = 0xe1
+	markerAPP2 = 0xe2
+	markerCOM  = 0xfe
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+// segment is a JPEG marker segment before the image data. raw holds the
+// whole segment, marker included, so it can be written back unchanged.
+type segment struct {
+	marker byte
+	raw    []byte
+}
+
+func (s segment) data() []byte {
+	return s.raw[4:]
+}
+
+func (s segment) isEXIF() bool {
+	return s.marker == markerAPP1 && bytes.HasPrefix(s.data(), exifHeader)
+}
+
+func (s segment) isXMP() bool {
+	return s.marker == markerAPP1 && bytes.HasPrefix(s.data(), xmpHeader)
+}
+
+// splitJPEG returns the segments of a JPEG up to the first scan, and the rest
+// of the file starting with the SOS marker.
+func splitJPEG(b []byte) ([]segment, []byte, error) {
+	if len(b) < 4 || b[0] != 0xff || b[1] != markerSOI {
+		return nil, nil, fmt.Errorf("split jpeg: missing SOI marker")
+	}
+	var segments []segment
+	i := 2
+	for {
+		if i+2 > len(b) || b[i] != 0xff {
+			return nil, nil, fmt.Errorf("split jpeg: malformed marker at %d", i)
+		}
+		start := i
+		// Markers may be preceded by any number of 0xff fill bytes.
+		for i < len(b) && b[i] == 0xff {
+			i++
+		}
+		if i >= len(b) {
+			return nil, nil, fmt.Errorf("split jpeg: truncated")
+		}
+		marker := b[i]
+		i++
+		switch {
+		case marker == markerSOS:
+			return segments, b[i-2:], nil
+		case marker == markerEOI:
+			return segments, b[i-2:], nil
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			// Standalone markers have no length.
+			continue
+		}
+		if i+2 > len(b) {
+			return nil, nil, fmt.Errorf("split jpeg: truncated")
+		}
+		length := int(binary.BigEndian.Uint16(b[i:]))
+		if length < 2 || i+length > len(b) {
+			return nil, nil, fmt.Errorf("split jpeg: bad segment length at %d", start)
+		}
+		i += length
+		// Normalize away fill bytes so raw always starts with 0xff marker.
+		raw := append([]byte{0xff, marker}, b[i-length:i]...)
+		segments = append(segments, segment{marker: marker, raw: raw})
+	}
+}
+
+// ReadEXIF extracts the EXIF metadata of a JPEG. It returns ErrNoEXIF if the
+// file has none.
+func ReadEXIF(b []byte) (*EXIF, error) {
+	segments, _, err := splitJPEG(b)
+	if err != nil {
+		return nil, fmt.Errorf("read exif: %w", err)
+	}
+	for _, s := range segments {
+		if s.isEXIF() {
+			t, err := parseTIFF(s.data()[len(exifHeader):])
+			if err != nil {
+				return nil, fmt.Errorf("read exif: %w", err)
+			}
+			return t.exif(), nil
+		}
+	}
+	return nil, ErrNoEXIF
+}
+
+// EXIF and GPS tags used here. See the EXIF 2.32 specification.
+const (
+	tagMake               = 0x010f
+	tagModel              = 0x0110
+	tagOrientation        = 0x0112
+	tagDateTime           = 0x0132
+	tagExifIFD            = 0x8769
+	tagGPSIFD             = 0x8825
+	tagExposureTime       = 0x829a
+	tagFNumber            = 0x829d
+	tagISO                = 0x8827
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+	tagFocalLength        = 0x920a
+	tagLensModel          = 0xa434
+	tagGPSLatitudeRef     = 0x0001
+	tagGPSLatitude        = 0x0002
+	tagGPSLongitudeRef    = 0x0003
+	tagGPSLongitude       = 0x0004
+)
+
+const (
+	typeByte      = 1
+	typeASCII     = 2
+	typeShort     = 3
+	typeLong      = 4
+	typeRational  = 5
+	typeUndefined = 7
+	typeSLong     = 9
+	typeSRational = 10
+)
+
+var typeSizes = map[uint16]int{
+	typeByte: 1, typeASCII: 1, typeShort: 2, typeLong: 4, typeRational: 8,
+	typeUndefined: 1, typeSLong: 4, typeSRational: 8,
+}
+
+// maxIFDEntries bounds how much of a corrupt or hostile IFD is read.
+const maxIFDEntries = 1000
+
+type ifdEntry struct {
+	typ   uint16
+	count uint32
+	// offset is where the value starts within the TIFF data.
+	offset int
+}
+
+type tiff struct {
+	b     []byte
+	order binary.ByteOrder
+	ifd0  map[uint16]ifdEntry
+	exifs map[uint16]ifdEntry
+	gps   map[uint16]ifdEntry
+}
+
+func parseTIFF(b []byte) (*tiff, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("tiff header truncated")
+	}
+	t := tiff{b: b}
+	switch string(b[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("unknown tiff byte order")
+	}
+	if t.order.Uint16(b[2:]) != 42 {
+		return nil, fmt.Errorf("bad tiff magic number")
+	}
+
+	var err error
+	t.ifd0, err = t.readIFD(int(t.order.Uint32(b[4:])))
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := t.ifd0[tagExifIFD]; ok {
+		// Sub-IFDs are optional extras; a broken one leaves the rest usable.
+		t.exifs, _ = t.readIFD(int(t.uint(e)))
+	}
+	if e, ok := t.ifd0[tagGPSIFD]; ok {
+		t.gps, _ = t.readIFD(int(t.uint(e)))
+	}
+	return &t, nil
+}
+
+func (t *tiff) readIFD(offset int) (map[uint16]ifdEntry, error) {
+	if offset < 8 || offset+2 > len(t.b) {
+		return nil, fmt.Errorf("ifd offset out of range")
+	}
+	n := int(t.order.Uint16(t.b[offset:]))
+	if n > maxIFDEntries || offset+2+n*12 > len(t.b) {
+		return nil, fmt.Errorf("ifd truncated")
+	}
+	entries := make(map[uint16]ifdEntry, n)
+	for i := 0; i < n; i++ {
+		p := offset + 2 + i*12
+		e := ifdEntry{
+			typ:   t.order.Uint16(t.b[p+2:]),
+			count: t.order.Uint32(t.b[p+4:]),
+		}
+		size, ok := typeSizes[e.typ]
+		if !ok {
+			continue
+		}
+		total := uint64(size) * uint64(e.count)
+		if total <= 4 {
+			e.offset = p + 8
+		} else {
+			e.offset = int(t.order.Uint32(t.b[p+8:]))
+		}
+		if total > uint64(len(t.b)) || e.offset < 0 || e.offset+int(total) > len(t.b) {
+			continue
+		}
+		entries[t.order.Uint16(t.b[p:])] = e
+	}
+	return entries, nil
+}
+
+// uint returns the first value of a BYTE, SHORT or LONG entry.
+func (t *tiff) uint(e ifdEntry) uint32 {
+	if e.count == 0 {
+		return 0
+	}
+	switch e.typ {
+	case typeByte:
+		return uint32(t.b[e.offset])
+	case typeShort:
+		return uint32(t.order.Uint16(t.b[e.offset:]))
+	case typeLong:
+		return t.order.Uint32(t.b[e.offset:])
+	}
+	return 0
+}
+
+func (t *tiff) string(e ifdEntry) string {
+	if e.typ != typeASCII {
+		return ""
+	}
+	s := string(t.b[e.offset : e.offset+int(e.count)])
+	s, _, _ = strings.Cut(s, "\x00")
+	return strings.TrimSpace(s)
+}
+
+// rational returns the i-th numerator and denominator of a RATIONAL entry.
+func (t *tiff) rational(e ifdEntry, i int) (uint32, uint32, bool) {
+	if (e.typ != typeRational && e.typ != typeSRational) || uint32(i) >= e.count {
+		return 0, 0, false
+	}
+	p := e.offset + i*8
+	num, den := t.order.Uint32(t.b[p:]), t.order.Uint32(t.b[p+4:])
+	if den == 0 {
+		return 0, 0, false
+	}
+	return num, den, true
+}
+
+func (t *tiff) float(e ifdEntry, i int) (float64, bool) {
+	num, den, ok := t.rational(e, i)
+	if !ok {
+		return 0, false
+	}
+	if e.typ == typeSRational {
+		return float64(int32(num)) / float64(int32(den)), true
+	}
+	return float64(num) / float64(den), true
+}
+
+func (t *tiff) exif() *EXIF {
+	var x EXIF
+	if e, ok := t.ifd0[tagMake]; ok {
+		x.Make = t.string(e)
+	}
+	if e, ok := t.ifd0[tagModel]; ok {
+		x.Model = t.string(e)
+	}
+	x.Orientation = 1
+	if e, ok := t.ifd0[tagOrientation]; ok {
+		if o := int(t.uint(e)); o >= 1 && o <= 8 {
+			x.Orientation = o
+		}
+	}
+	if e, ok := t.exifs[tagLensModel]; ok {
+		x.LensModel = t.string(e)
+	}
+	if e, ok := t.exifs[tagExposureTime]; ok {
+		if num, den, ok := t.rational(e, 0); ok {
+			x.ExposureTime = formatExposure(num, den)
+		}
+	}
+	if e, ok := t.exifs[tagFNumber]; ok {
+		x.FNumber, _ = t.float(e, 0)
+	}
+	if e, ok := t.exifs[tagISO]; ok {
+		x.ISO = int(t.uint(e))
+	}
+	if e, ok := t.exifs[tagFocalLength]; ok {
+		x.FocalLength, _ = t.float(e, 0)
+	}
+
+	taken, ok := t.exifs[tagDateTimeOriginal]
+	if !ok {
+		taken, ok = t.ifd0[tagDateTime]
+	}
+	if ok {
+		var offset string
+		if e, ok := t.exifs[tagOffsetTimeOriginal]; ok {
+			offset = t.string(e)
+		}
+		x.TakenAt = parseEXIFTime(t.string(taken), offset)
+	}
+
+	x.GPS = t.location()
+	return &x
+}
+
+func (t *tiff) location() *GPS {
+	lat, ok := t.degrees(tagGPSLatitude)
+	if !ok {
+		return nil
+	}
+	lon, ok := t.degrees(tagGPSLongitude)
+	if !ok {
+		return nil
+	}
+	if e, ok := t.gps[tagGPSLatitudeRef]; ok && t.string(e) == "S" {
+		lat = -lat
+	}
+	if e, ok := t.gps[tagGPSLongitudeRef]; ok && t.string(e) == "W" {
+		lon = -lon
+	}
+	if math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+		return nil
+	}
+	return &GPS{Latitude: lat, Longitude: lon}
+}
+
+// degrees reads a GPS coordinate stored as degrees, minutes and seconds.
+func (t *tiff) degrees(tag uint16) (float64, bool) {
+	e, ok := t.gps[tag]
+	if !ok || e.count < 3 {
+		return 0, false
+	}
+	var dms [3]float64
+	for i := range dms {
+		v, ok := t.float(e, i)
+		if !ok {
+			return 0, false
+		}
+		dms[i] = v
+	}
+	return dms[0] + dms[1]/60 + dms[2]/3600, true
+}
+
+// formatExposure shows exposures under a second as fractions, as cameras do.
+func formatExposure(num, den uint32) string {
+	if num >= den {
+		return trimFloat(float64(num) / float64(den))
+	}
+	if num == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("1/%d", int(math.Round(float64(den)/float64(num))))
+}
+
+func trimFloat(f float64) string {
+	return strings.TrimSuffix(strings.TrimRight(fmt.Sprintf("%.1f", f), "0"), ".")
+}
+
+// parseEXIFTime parses the "2006:01:02 15:04:05" timestamps of EXIF. Without
+// an offset the time is local to the camera, which is reported as UTC.
+func parseEXIFTime(s, offset string) time.Time {
+	layout := "2006:01:02 15:04:05"
+	if offset != "" {
+		t, err := time.Parse(layout+"-07:00", s+offset)
+		if err == nil {
+			return t
+		}
+	}
+	t, err := time.Parse(layout, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
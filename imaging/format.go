@@ -0,0 +1,188 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+
+	// Registers the WebP decoder with image.Decode and image.DecodeConfig.
+	_ "golang.org/x/image/webp"
+)
+
+// Format describes an image format uploads may use.
+type Format struct {
+	// Name identifies the format in configuration, e.g. "jpeg".
+	Name        string
+	ContentType string
+	// Extensions are the file extensions the format is saved with; the
+	// first one is used when a file has to be renamed.
+	Extensions []string
+	// Decode and Encode report whether this package can read and write the
+	// format. Renditions need Decode; formats without Encode get their
+	// renditions in FallbackFormat.
+	Decode bool
+	Encode bool
+
+	sniff func(b []byte) bool
+}
+
+// Extension is the extension files in this format are saved with.
+func (f Format) Extension() string {
+	return f.Extensions[0]
+}
+
+// HasExtension reports whether name ends in one of the format's extensions,
+// ignoring case.
+func (f Format) HasExtension(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range f.Extensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	JPEG = Format{
+		Name:        "jpeg",
+		ContentType: "image/jpeg",
+		Extensions:  []string{".jpg", ".jpeg"},
+		Decode:      true,
+		Encode:      true,
+		sniff:       prefix("\xff\xd8\xff"),
+	}
+	PNG = Format{
+		Name:        "png",
+		ContentType: "image/png",
+		Extensions:  []string{".png"},
+		Decode:      true,
+		Encode:      true,
+		sniff:       prefix("\x89PNG\r\n\x1a\n"),
+	}
+	GIF = Format{
+		Name:        "gif",
+		ContentType: "image/gif",
+		Extensions:  []string{".gif"},
+		Decode:      true,
+		Encode:      true,
+		sniff: func(b []byte) bool {
+			return prefix("GIF87a")(b) || prefix("GIF89a")(b)
+		},
+	}
+	WebP = Format{
+		Name:        "webp",
+		ContentType: "image/webp",
+		Extensions:  []string{".webp"},
+		Decode:      true,
+		sniff: func(b []byte) bool {
+			return len(b) >= 12 && string(b[:4]) == "RIFF" && string(b[8:12]) == "WEBP"
+		},
+	}
+	AVIF = Format{
+		Name:        "avif",
+		ContentType: "image/avif",
+		Extensions:  []string{".avif"},
+		sniff:       ftypBrand("avif", "avis"),
+	}
+	// HEIC is what iPhones save photos as. Few browsers can display it and
+	// it cannot be converted here, so it is not allowed by default.
+	HEIC = Format{
+		Name:        "heic",
+		ContentType: "image/heic",
+		Extensions:  []string{".heic", ".heif"},
+		sniff:       ftypBrand("heic", "heix", "heim", "heis", "hevc", "hevx", "mif1", "msf1"),
+	}
+)
+
+// Formats lists every format this package recognizes. AVIF comes before
+// HEIC since AVIF files often also carry the generic HEIF brand.
+var Formats = []Format{JPEG, PNG, GIF, WebP, AVIF, HEIC}
+
+// FallbackFormat is used for renditions of formats that cannot be encoded.
+// Every browser displays it.
+var FallbackFormat = JPEG
+
+// FormatByName returns the format with the given name.
+func FormatByName(name string) (Format, bool) {
+	for _, f := range Formats {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+// FormatByContentType returns the format with the given content type.
+func FormatByContentType(contentType string) (Format, bool) {
+	for _, f := range Formats {
+		if f.ContentType == contentType {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+// FormatByExtension returns the format a file name's extension belongs to.
+func FormatByExtension(name string) (Format, bool) {
+	for _, f := range Formats {
+		if f.HasExtension(name) {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+// Sniff identifies the format of an image from its first bytes. 512 bytes
+// are enough for every format.
+func Sniff(b []byte) (Format, bool) {
+	for _, f := range Formats {
+		if f.sniff(b) {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+// RenditionFormat is the format renditions of an image in f are encoded in.
+func RenditionFormat(f Format) Format {
+	if f.Encode {
+		return f
+	}
+	return FallbackFormat
+}
+
+func prefix(magic string) func([]byte) bool {
+	return func(b []byte) bool {
+		return bytes.HasPrefix(b, []byte(magic))
+	}
+}
+
+// ftypBrand matches ISO base media files, the container of AVIF and HEIC,
+// whose leading ftyp box names one of the brands as its major brand or as a
+// compatible brand.
+func ftypBrand(brands ...string) func([]byte) bool {
+	return func(b []byte) bool {
+		if len(b) < 16 || string(b[4:8]) != "ftyp" {
+			return false
+		}
+		size := int(binary.BigEndian.Uint32(b))
+		if size < 16 || size > len(b) {
+			size = len(b)
+		}
+		// The major brand is followed by a minor version, then the
+		// compatible brands.
+		candidates := []string{string(b[8:12])}
+		for i := 16; i+4 <= size; i += 4 {
+			candidates = append(candidates, string(b[i:i+4]))
+		}
+		for _, c := range candidates {
+			for _, brand := range brands {
+				if c == brand {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,175 @@
+package imaging
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	ErrNoHEIFSize = errors.New("imaging: no heif image size")
+)
+
+// HEIFSize reads the display size of an AVIF or HEIC image from its
+// container without decoding it. The size is that of the primary item,
+// rotated as it is displayed.
+func HEIFSize(b []byte) (width, height int, err error) {
+	meta, ok := findBox(b, "meta")
+	if !ok || len(meta) < 4 {
+		return 0, 0, ErrNoHEIFSize
+	}
+	// meta is a full box: a version and flags precede its children.
+	meta = meta[4:]
+
+	primary := -1
+	if pitm, ok := findBox(meta, "pitm"); ok && len(pitm) >= 6 {
+		if pitm[0] == 0 {
+			primary = int(binary.BigEndian.Uint16(pitm[4:]))
+		} else if len(pitm) >= 8 {
+			primary = int(binary.BigEndian.Uint32(pitm[4:]))
+		}
+	}
+	iprp, ok := findBox(meta, "iprp")
+	if !ok {
+		return 0, 0, ErrNoHEIFSize
+	}
+	ipco, ok := findBox(iprp, "ipco")
+	if !ok {
+		return 0, 0, ErrNoHEIFSize
+	}
+	properties := boxes(ipco)
+
+	// Properties are associated with items by their 1-based index in ipco.
+	var indexes []int
+	if ipma, ok := findBox(iprp, "ipma"); ok && primary >= 0 {
+		indexes = itemProperties(ipma, primary)
+	}
+	if len(indexes) == 0 {
+		// Without associations, the largest image is the best guess.
+		for i := range properties {
+			indexes = append(indexes, i+1)
+		}
+	}
+
+	rotated := false
+	for _, i := range indexes {
+		if i < 1 || i > len(properties) {
+			continue
+		}
+		p := properties[i-1]
+		switch p.typ {
+		case "ispe":
+			if len(p.data) < 12 {
+				continue
+			}
+			w := int(binary.BigEndian.Uint32(p.data[4:]))
+			h := int(binary.BigEndian.Uint32(p.data[8:]))
+			if w*h > width*height {
+				width, height = w, h
+			}
+		case "irot":
+			if len(p.data) >= 1 {
+				rotated = p.data[0]&1 == 1
+			}
+		}
+	}
+	if width == 0 || height == 0 {
+		return 0, 0, ErrNoHEIFSize
+	}
+	if rotated {
+		width, height = height, width
+	}
+	return width, height, nil
+}
+
+type box struct {
+	typ  string
+	data []byte
+}
+
+// boxes splits b into ISO base media boxes, stopping at the first one that
+// does not fit.
+func boxes(b []byte) []box {
+	var out []box
+	for len(b) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(b))
+		typ := string(b[4:8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(b))
+		case 1:
+			if len(b) < 16 {
+				return out
+			}
+			size = binary.BigEndian.Uint64(b[8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(b)) {
+			return out
+		}
+		out = append(out, box{typ: typ, data: b[header:size]})
+		b = b[size:]
+	}
+	return out
+}
+
+func findBox(b []byte, typ string) ([]byte, bool) {
+	for _, bx := range boxes(b) {
+		if bx.typ == typ {
+			return bx.data, true
+		}
+	}
+	return nil, false
+}
+
+// itemProperties returns the ipco indexes of the properties of an item.
+func itemProperties(ipma []byte, item int) []int {
+	if len(ipma) < 8 {
+		return nil
+	}
+	version := ipma[0]
+	wideIndex := ipma[3]&1 == 1
+	count := int(binary.BigEndian.Uint32(ipma[4:]))
+	p := ipma[8:]
+	for ; count > 0; count-- {
+		var id int
+		if version < 1 {
+			if len(p) < 2 {
+				return nil
+			}
+			id, p = int(binary.BigEndian.Uint16(p)), p[2:]
+		} else {
+			if len(p) < 4 {
+				return nil
+			}
+			id, p = int(binary.BigEndian.Uint32(p)), p[4:]
+		}
+		if len(p) < 1 {
+			return nil
+		}
+		n := int(p[0])
+		p = p[1:]
+
+		var indexes []int
+		for ; n > 0; n-- {
+			// The top bit of each association marks it essential.
+			if wideIndex {
+				if len(p) < 2 {
+					return nil
+				}
+				indexes = append(indexes, int(binary.BigEndian.Uint16(p)&0x7fff))
+				p = p[2:]
+			} else {
+				if len(p) < 1 {
+					return nil
+				}
+				indexes = append(indexes, int(p[0]&0x7f))
+				p = p[1:]
+			}
+		}
+		if id == item {
+			return indexes
+		}
+	}
+	return nil
+}
@@ -0,0 +1,406 @@
+package imaging
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var (
+	ErrCannotStripGPS = errors.New("imaging: cannot strip gps from this image")
+)
+
+// StripGPS removes location metadata from an image in a format other than
+// JPEG, which CleanJPEG handles. Like CleanJPEG, it drops whole EXIF and XMP
+// blocks that carry a location and returns src unchanged when there is
+// nothing to do. The metadata of AVIF and HEIC images lives inside the
+// container's item tables and cannot be dropped without rewriting them, so
+// StripGPS returns ErrCannotStripGPS for those if they carry a location.
+// GIFs have no EXIF and are returned as is.
+func StripGPS(src []byte, f Format) ([]byte, error) {
+	switch f.Name {
+	case WebP.Name:
+		return stripWebP(src)
+	case PNG.Name:
+		return stripPNG(src)
+	case AVIF.Name, HEIC.Name:
+		if heifHasGPS(src) {
+			return nil, ErrCannotStripGPS
+		}
+	}
+	return src, nil
+}
+
+// exifHasGPS reports whether TIFF formatted EXIF may hold a location.
+// Unreadable EXIF could still hold one.
+func exifHasGPS(b []byte) bool {
+	b = bytes.TrimPrefix(b, exifHeader)
+	t, err := parseTIFF(b)
+	if err != nil {
+		return true
+	}
+	_, ok := t.ifd0[tagGPSIFD]
+	return ok
+}
+
+func xmpHasGPS(b []byte) bool {
+	return bytes.Contains(b, []byte("GPSLatitude")) || bytes.Contains(b, []byte("GPSLongitude"))
+}
+
+// VP8X flags announcing EXIF and XMP chunks.
+const (
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+// stripWebP drops the EXIF and XMP chunks of a WebP that carry a location,
+// clearing their VP8X flags and fixing up the RIFF size.
+func stripWebP(src []byte) ([]byte, error) {
+	if len(src) < 12 || string(src[:4]) != "RIFF" || string(src[8:12]) != "WEBP" {
+		return nil, fmt.Errorf("strip webp: not a webp file")
+	}
+	var out bytes.Buffer
+	out.Write(src[:12])
+	var cleared byte
+	vp8x := -1
+	for b := src[12:]; len(b) > 0; {
+		if len(b) < 8 {
+			return nil, fmt.Errorf("strip webp: chunk header truncated")
+		}
+		size := uint64(binary.LittleEndian.Uint32(b[4:]))
+		// Chunks are padded to an even size.
+		padded := size + size&1
+		if 8+padded > uint64(len(b)) {
+			if 8+size != uint64(len(b)) {
+				return nil, fmt.Errorf("strip webp: chunk truncated")
+			}
+			// Some encoders leave out the padding of the last chunk.
+			padded = size
+		}
+		chunk, data := b[:8+padded], b[8:8+size]
+		b = b[8+padded:]
+
+		switch string(chunk[:4]) {
+		case "EXIF":
+			if exifHasGPS(data) {
+				cleared |= webpFlagEXIF
+				continue
+			}
+		case "XMP ":
+			if xmpHasGPS(data) {
+				cleared |= webpFlagXMP
+				continue
+			}
+		case "VP8X":
+			if size >= 1 {
+				vp8x = out.Len() + 8
+			}
+		}
+		out.Write(chunk)
+	}
+	if cleared == 0 {
+		return src, nil
+	}
+
+	stripped := out.Bytes()
+	if vp8x >= 0 {
+		stripped[vp8x] &^= cleared
+	}
+	binary.LittleEndian.PutUint32(stripped[4:], uint32(len(stripped)-8))
+	return stripped, nil
+}
+
+// pngSignature starts every PNG file.
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// stripPNG drops the chunks of a PNG that carry a location: eXIf, XMP in
+// text chunks, and the hex encoded profiles some tools store EXIF in.
+func stripPNG(src []byte) ([]byte, error) {
+	if !bytes.HasPrefix(src, []byte(pngSignature)) {
+		return nil, fmt.Errorf("strip png: not a png file")
+	}
+	var out bytes.Buffer
+	out.WriteString(pngSignature)
+	dropped := false
+	for b := src[len(pngSignature):]; len(b) > 0; {
+		if len(b) < 12 {
+			return nil, fmt.Errorf("strip png: chunk truncated")
+		}
+		size := uint64(binary.BigEndian.Uint32(b))
+		if 12+size > uint64(len(b)) {
+			return nil, fmt.Errorf("strip png: chunk truncated")
+		}
+		chunk, typ, data := b[:12+size], string(b[4:8]), b[8:8+size]
+		b = b[12+size:]
+
+		if pngChunkHasGPS(typ, data) {
+			dropped = true
+			continue
+		}
+		out.Write(chunk)
+		if typ == "IEND" {
+			break
+		}
+	}
+	if !dropped {
+		return src, nil
+	}
+	return out.Bytes(), nil
+}
+
+// maxXMPSize bounds how much of a compressed XMP chunk is inflated.
+const maxXMPSize = 1 << 20
+
+func pngChunkHasGPS(typ string, data []byte) bool {
+	switch typ {
+	case "eXIf":
+		return exifHasGPS(data)
+	case "tEXt", "zTXt", "iTXt":
+	default:
+		return false
+	}
+
+	keyword, text, ok := bytes.Cut(data, []byte{0})
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(string(keyword), "Raw profile type ") {
+		// Hex encoded EXIF or XMP; not worth decoding to keep.
+		return true
+	}
+	if string(keyword) != "XML:com.adobe.xmp" {
+		return false
+	}
+	compressed := typ == "zTXt"
+	if typ == "iTXt" {
+		// A compression flag and method, then a language tag and a
+		// translated keyword precede the text.
+		if len(text) < 2 {
+			return true
+		}
+		compressed = text[0] == 1
+		text = text[2:]
+		for i := 0; i < 2; i++ {
+			_, text, ok = bytes.Cut(text, []byte{0})
+			if !ok {
+				return true
+			}
+		}
+	} else if compressed {
+		// The compression method precedes the text.
+		if len(text) < 1 {
+			return true
+		}
+		text = text[1:]
+	}
+	if compressed {
+		zr, err := zlib.NewReader(bytes.NewReader(text))
+		if err != nil {
+			return true
+		}
+		text, err = io.ReadAll(io.LimitReader(zr, maxXMPSize))
+		if err != nil {
+			return true
+		}
+	}
+	return xmpHasGPS(text)
+}
+
+// heifHasGPS reports whether the EXIF or XMP items of an AVIF or HEIC image
+// may hold a location.
+func heifHasGPS(b []byte) bool {
+	meta, ok := findBox(b, "meta")
+	if !ok || len(meta) < 4 {
+		return false
+	}
+	meta = meta[4:]
+	iinf, ok := findBox(meta, "iinf")
+	if !ok {
+		return false
+	}
+	items := metadataItems(iinf)
+	if len(items) == 0 {
+		return false
+	}
+	iloc, ok := findBox(meta, "iloc")
+	if !ok {
+		return true
+	}
+	for id, typ := range items {
+		data, ok := itemData(b, iloc, id)
+		if !ok {
+			// Data that cannot be found cannot be checked.
+			return true
+		}
+		switch typ {
+		case "Exif":
+			// The TIFF header follows an offset to it.
+			if len(data) < 4 {
+				return true
+			}
+			start := uint64(binary.BigEndian.Uint32(data)) + 4
+			if start > uint64(len(data)) || exifHasGPS(data[start:]) {
+				return true
+			}
+		case "mime":
+			if xmpHasGPS(data) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// metadataItems returns the IDs of the EXIF and MIME typed items listed in
+// an iinf box, keyed to their type. MIME items of HEIF images hold XMP.
+func metadataItems(iinf []byte) map[int]string {
+	if len(iinf) < 6 {
+		return nil
+	}
+	entries := iinf[6:]
+	if iinf[0] > 0 {
+		if len(iinf) < 8 {
+			return nil
+		}
+		entries = iinf[8:]
+	}
+	items := make(map[int]string)
+	for _, bx := range boxes(entries) {
+		// Only infe versions 2 and 3 give the item type.
+		if bx.typ != "infe" || len(bx.data) < 4 || bx.data[0] < 2 {
+			continue
+		}
+		p := bx.data[4:]
+		var id int
+		if bx.data[0] == 2 {
+			if len(p) < 2 {
+				continue
+			}
+			id, p = int(binary.BigEndian.Uint16(p)), p[2:]
+		} else {
+			if len(p) < 4 {
+				continue
+			}
+			id, p = int(binary.BigEndian.Uint32(p)), p[4:]
+		}
+		// The protection index precedes the type.
+		if len(p) < 6 {
+			continue
+		}
+		typ := string(p[2:6])
+		if typ == "Exif" || typ == "mime" {
+			items[id] = typ
+		}
+	}
+	return items
+}
+
+// itemData returns the contents of an item stored in the file itself, as
+// located by an iloc box.
+func itemData(b, iloc []byte, item int) ([]byte, bool) {
+	if len(iloc) < 6 {
+		return nil, false
+	}
+	version := iloc[0]
+	offsetSize := int(iloc[4] >> 4)
+	lengthSize := int(iloc[4] & 0x0f)
+	baseOffsetSize := int(iloc[5] >> 4)
+	indexSize := 0
+	if version == 1 || version == 2 {
+		indexSize = int(iloc[5] & 0x0f)
+	}
+	p := iloc[6:]
+
+	next := func(size int) (uint64, bool) {
+		if len(p) < size {
+			return 0, false
+		}
+		var v uint64
+		switch size {
+		case 0:
+		case 2:
+			v = uint64(binary.BigEndian.Uint16(p))
+		case 4:
+			v = uint64(binary.BigEndian.Uint32(p))
+		case 8:
+			v = binary.BigEndian.Uint64(p)
+		default:
+			return 0, false
+		}
+		p = p[size:]
+		return v, true
+	}
+	idSize := 2
+	if version == 2 {
+		idSize = 4
+	}
+
+	count, ok := next(idSize)
+	if !ok {
+		return nil, false
+	}
+	for ; count > 0; count-- {
+		id, ok := next(idSize)
+		if !ok {
+			return nil, false
+		}
+		method := uint64(0)
+		if version == 1 || version == 2 {
+			if method, ok = next(2); !ok {
+				return nil, false
+			}
+			method &= 0x0f
+		}
+		// The data reference index, then the base offset.
+		if _, ok = next(2); !ok {
+			return nil, false
+		}
+		base, ok := next(baseOffsetSize)
+		if !ok {
+			return nil, false
+		}
+		extents, ok := next(2)
+		if !ok {
+			return nil, false
+		}
+
+		// Items in the idat box or built from other items are not
+		// located by file offset.
+		wanted := int(id) == item && method == 0
+		var data []byte
+		for ; extents > 0; extents-- {
+			if _, ok = next(indexSize); !ok {
+				return nil, false
+			}
+			offset, ok := next(offsetSize)
+			if !ok {
+				return nil, false
+			}
+			length, ok := next(lengthSize)
+			if !ok {
+				return nil, false
+			}
+			if !wanted {
+				continue
+			}
+			start := base + offset
+			end := start + length
+			if length == 0 {
+				end = uint64(len(b))
+			}
+			if start > end || end > uint64(len(b)) {
+				return nil, false
+			}
+			data = append(data, b[start:end]...)
+		}
+		if int(id) != item {
+			continue
+		}
+		return data, wanted
+	}
+	return nil, false
+}
@@ -0,0 +1,185 @@
+package imaging
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+)
+
+// Orient transforms src as described by an EXIF orientation so it displays
+// upright without the tag. Orientations 5 to 8 swap width and height.
+func Orient(src image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	rgba := toRGBA(src)
+	w, h := rgba.Rect.Dx(), rgba.Rect.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	// Each source row maps to a line of the destination, so only its
+	// start and the step between pixels depend on the orientation. Copying
+	// bytes directly instead of through At and Set keeps large photos fast.
+	stride := dst.Stride
+	for y := 0; y < h; y++ {
+		var i, step int
+		switch orientation {
+		case 2: // mirrored horizontally
+			i, step = y*stride+(w-1)*4, -4
+		case 3: // rotated 180°
+			i, step = (h-1-y)*stride+(w-1)*4, -4
+		case 4: // mirrored vertically
+			i, step = (h-1-y)*stride, 4
+		case 5: // mirrored along the top-left diagonal
+			i, step = y*4, stride
+		case 6: // rotated 90° clockwise to display
+			i, step = (h-1-y)*4, stride
+		case 7: // mirrored along the top-right diagonal
+			i, step = (w-1)*stride+(h-1-y)*4, -stride
+		case 8: // rotated 90° counter-clockwise to display
+			i, step = (w-1)*stride+y*4, -stride
+		}
+		row := rgba.Pix[y*rgba.Stride : y*rgba.Stride+w*4]
+		for x := 0; x < len(row); x += 4 {
+			p := dst.Pix[i : i+4 : i+4]
+			p[0], p[1], p[2], p[3] = row[x], row[x+1], row[x+2], row[x+3]
+			i += step
+		}
+	}
+	return dst
+}
+
+// toRGBA returns src as an RGBA image with its origin at zero. Converting
+// with draw takes its fast paths for the YCbCr, gray and CMYK images JPEGs
+// decode to.
+func toRGBA(src image.Image) *image.RGBA {
+	if rgba, ok := src.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+	return dst
+}
+
+// CleanJPEG rewrites a JPEG so it displays upright without relying on the
+// EXIF orientation tag and, when stripGPS is set, without location metadata.
+// Rotating re-encodes the image; otherwise the image data is copied as is and
+// only metadata segments are dropped. src is returned unchanged when there is
+// nothing to do.
+//
+// EXIF cannot be partly removed without rewriting its offsets, so a photo
+// with GPS loses its whole EXIF segment. Callers that want the other fields
+// should read them with ReadEXIF first.
+func CleanJPEG(src []byte, stripGPS bool) ([]byte, error) {
+	segments, scan, err := splitJPEG(src)
+	if err != nil {
+		return nil, fmt.Errorf("clean jpeg: %w", err)
+	}
+
+	orientation := 1
+	hasGPS := false
+	for _, s := range segments {
+		if !s.isEXIF() {
+			continue
+		}
+		t, err := parseTIFF(s.data()[len(exifHeader):])
+		if err != nil {
+			// Unreadable EXIF could still hold a location.
+			hasGPS = true
+			break
+		}
+		x := t.exif()
+		orientation = x.Orientation
+		hasGPS = x.GPS != nil || t.gps != nil
+	}
+
+	drop := func(s segment) bool {
+		if !stripGPS {
+			return false
+		}
+		switch {
+		case s.isEXIF():
+			return hasGPS
+		case s.isXMP():
+			return xmpHasGPS(s.data())
+		}
+		return false
+	}
+
+	var kept []segment
+	dropped := false
+	for _, s := range segments {
+		if drop(s) {
+			dropped = true
+			continue
+		}
+		kept = append(kept, s)
+	}
+	rotate := orientation != 1
+	if !rotate && !dropped {
+		return src, nil
+	}
+
+	var out bytes.Buffer
+	out.Write([]byte{0xff, markerSOI})
+	if !rotate {
+		for _, s := range kept {
+			out.Write(s.raw)
+		}
+		out.Write(scan)
+		return out.Bytes(), nil
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(src))
+	if err != nil {
+		return nil, fmt.Errorf("clean jpeg: %w", err)
+	}
+	var encoded bytes.Buffer
+	err = jpeg.Encode(&encoded, Orient(img, orientation), &jpeg.Options{Quality: JPEGQuality})
+	if err != nil {
+		return nil, fmt.Errorf("clean jpeg: %w", err)
+	}
+	encodedSegments, encodedScan, err := splitJPEG(encoded.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("clean jpeg: %w", err)
+	}
+
+	// Carry over the metadata that still applies to the re-encoded pixels:
+	// JFIF, EXIF with its orientation reset, XMP, colour profiles and
+	// comments. Segments that describe the old encoding are left behind.
+	for _, s := range kept {
+		switch {
+		case s.isEXIF():
+			out.Write(resetOrientation(s))
+		case s.marker == markerAPP0, s.marker == markerAPP1, s.marker == markerAPP2, s.marker == markerCOM:
+			out.Write(s.raw)
+		}
+	}
+	for _, s := range encodedSegments {
+		out.Write(s.raw)
+	}
+	out.Write(encodedScan)
+	return out.Bytes(), nil
+}
+
+// resetOrientation returns a copy of an EXIF segment with its orientation
+// tag set to 1, upright.
+func resetOrientation(s segment) []byte {
+	raw := append([]byte(nil), s.raw...)
+	tiffStart := 4 + len(exifHeader)
+	t, err := parseTIFF(raw[tiffStart:])
+	if err != nil {
+		return raw
+	}
+	e, ok := t.ifd0[tagOrientation]
+	if !ok || e.typ != typeShort {
+		return raw
+	}
+	t.order.PutUint16(raw[tiffStart+e.offset:], 1)
+	return raw
+}
@@ -0,0 +1,116 @@
+// Package imaging implements the pure Go image processing used for gallery
+// renditions.
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+const (
+	JPEGQuality = 85
+)
+
+// Fit scales src down so it is at most maxWidth pixels wide, keeping the
+// aspect ratio. Images that already fit are returned unchanged; images are
+// never scaled up.
+func Fit(src image.Image, maxWidth int) image.Image {
+	b := src.Bounds()
+	if maxWidth <= 0 || b.Dx() <= maxWidth {
+		return src
+	}
+	height := b.Dy() * maxWidth / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+	return Resize(src, maxWidth, height)
+}
+
+// FitSize returns the dimensions Fit would produce for an image of the given
+// size.
+func FitSize(width, height, maxWidth int) (int, int) {
+	if maxWidth <= 0 || width <= maxWidth {
+		return width, height
+	}
+	h := height * maxWidth / width
+	if h < 1 {
+		h = 1
+	}
+	return maxWidth, h
+}
+
+// Resize scales src to exactly width x height. Each destination pixel is the
+// average of the source pixels it covers, which gives good results when
+// shrinking photos.
+func Resize(src image.Image, width, height int) *image.RGBA {
+	sb := src.Bounds()
+	sw, sh := sb.Dx(), sb.Dy()
+
+	// Work on premultiplied RGBA so averaging respects transparency.
+	s, ok := src.(*image.RGBA)
+	if !ok || sb.Min != (image.Point{}) {
+		s = image.NewRGBA(image.Rect(0, 0, sw, sh))
+		draw.Draw(s, s.Bounds(), src, sb.Min, draw.Src)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		sy0 := y * sh / height
+		sy1 := max((y+1)*sh/height, sy0+1)
+		for x := 0; x < width; x++ {
+			sx0 := x * sw / width
+			sx1 := max((x+1)*sw/width, sx0+1)
+
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				i := s.PixOffset(sx0, sy)
+				for sx := sx0; sx < sx1; sx++ {
+					r += uint64(s.Pix[i])
+					g += uint64(s.Pix[i+1])
+					b += uint64(s.Pix[i+2])
+					a += uint64(s.Pix[i+3])
+					i += 4
+					n++
+				}
+			}
+			j := dst.PixOffset(x, y)
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(b / n)
+			dst.Pix[j+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// Encode writes img to w in the format identified by contentType.
+func Encode(w io.Writer, img image.Image, contentType string) error {
+	switch contentType {
+	case "image/jpeg", "image/jpg":
+		return jpeg.Encode(w, flatten(img), &jpeg.Options{Quality: JPEGQuality})
+	case "image/png":
+		return png.Encode(w, img)
+	case "image/gif":
+		return gif.Encode(w, img, nil)
+	default:
+		return fmt.Errorf("encode: unsupported content type %v", contentType)
+	}
+}
+
+// flatten draws images with transparency onto white, since JPEG would
+// otherwise turn transparent pixels black.
+func flatten(img image.Image) image.Image {
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return img
+	}
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, b, img, b.Min, draw.Over)
+	return dst
+}
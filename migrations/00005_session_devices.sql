@@ -0,0 +1,43 @@
+-- +goose Up
+-- +goose StatementBegin
+DELETE FROM sessions
+WHERE
+    user_id IS NULL;
+
+ALTER TABLE sessions
+DROP CONSTRAINT sessions_user_id_key;
+
+ALTER TABLE sessions
+ALTER COLUMN user_id SET NOT NULL,
+ADD COLUMN user_agent TEXT NOT NULL DEFAULT '',
+ADD COLUMN ip_address TEXT NOT NULL DEFAULT '',
+ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+ADD COLUMN last_seen_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX sessions_user_id_idx;
+
+DELETE FROM sessions
+WHERE
+    id NOT IN (
+        SELECT
+            MAX(id)
+        FROM
+            sessions
+        GROUP BY
+            user_id
+    );
+
+ALTER TABLE sessions
+DROP COLUMN user_agent,
+DROP COLUMN ip_address,
+DROP COLUMN created_at,
+DROP COLUMN last_seen_at,
+ALTER COLUMN user_id DROP NOT NULL,
+ADD CONSTRAINT sessions_user_id_key UNIQUE (user_id);
+
+-- +goose StatementEnd
@@ -0,0 +1,31 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE sessions
+ADD COLUMN expires_at TIMESTAMPTZ,
+ADD COLUMN idle_expires_at TIMESTAMPTZ;
+
+UPDATE sessions
+SET
+    expires_at = created_at + INTERVAL '30 days',
+    idle_expires_at = last_seen_at + INTERVAL '7 days';
+
+ALTER TABLE sessions
+ALTER COLUMN expires_at SET NOT NULL,
+ALTER COLUMN idle_expires_at SET NOT NULL;
+
+CREATE INDEX sessions_expires_at_idx ON sessions (expires_at);
+
+CREATE INDEX password_resets_expires_at_idx ON password_resets (expires_at);
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX password_resets_expires_at_idx;
+
+DROP INDEX sessions_expires_at_idx;
+
+ALTER TABLE sessions
+DROP COLUMN expires_at,
+DROP COLUMN idle_expires_at;
+
+-- +goose StatementEnd
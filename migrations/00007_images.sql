@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE
+    images (
+        id SERIAL PRIMARY KEY,
+        gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+        filename TEXT NOT NULL,
+        content_type TEXT NOT NULL,
+        byte_size BIGINT NOT NULL,
+        width INT NOT NULL DEFAULT 0,
+        height INT NOT NULL DEFAULT 0,
+        sha256 TEXT NOT NULL,
+        caption TEXT NOT NULL DEFAULT '',
+        uploaded_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        position INT NOT NULL DEFAULT 0,
+        UNIQUE (gallery_id, filename)
+    );
+
+CREATE INDEX images_sha256_idx ON images (sha256);
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE images;
+
+-- +goose StatementEnd
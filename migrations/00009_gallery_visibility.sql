@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE galleries
+ADD COLUMN visibility TEXT NOT NULL DEFAULT 'private' CHECK (visibility IN ('private', 'unlisted', 'public')),
+ADD COLUMN slug TEXT UNIQUE;
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries
+DROP COLUMN visibility,
+DROP COLUMN slug;
+
+-- +goose StatementEnd
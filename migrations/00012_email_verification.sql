@@ -0,0 +1,29 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+ADD COLUMN email_verified_at TIMESTAMPTZ;
+
+-- Accounts created before verification existed are treated as verified.
+UPDATE users
+SET
+    email_verified_at = now();
+
+CREATE TABLE
+    email_verifications (
+        id SERIAL PRIMARY KEY,
+        user_id INT UNIQUE NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+        token_hash TEXT UNIQUE NOT NULL,
+        expires_at TIMESTAMPTZ NOT NULL
+    );
+
+CREATE INDEX email_verifications_expires_at_idx ON email_verifications (expires_at);
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE email_verifications;
+
+ALTER TABLE users
+DROP COLUMN email_verified_at;
+
+-- +goose StatementEnd
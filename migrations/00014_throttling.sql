@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE
+    throttle_buckets (
+        key TEXT PRIMARY KEY,
+        tokens DOUBLE PRECISION NOT NULL,
+        updated_at TIMESTAMPTZ NOT NULL
+    );
+
+CREATE INDEX throttle_buckets_updated_at_idx ON throttle_buckets (updated_at);
+
+ALTER TABLE users
+ADD COLUMN failed_logins INT NOT NULL DEFAULT 0,
+ADD COLUMN locked_until TIMESTAMPTZ;
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users
+DROP COLUMN failed_logins,
+DROP COLUMN locked_until;
+
+DROP TABLE throttle_buckets;
+
+-- +goose StatementEnd
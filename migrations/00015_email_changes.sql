@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+CREATE TABLE
+    email_changes (
+        id SERIAL PRIMARY KEY,
+        user_id INT UNIQUE NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+        new_email TEXT NOT NULL,
+        token_hash TEXT UNIQUE NOT NULL,
+        expires_at TIMESTAMPTZ NOT NULL
+    );
+
+CREATE INDEX email_changes_expires_at_idx ON email_changes (expires_at);
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE email_changes;
+
+ALTER TABLE users
+DROP COLUMN created_at;
+
+-- +goose StatementEnd
@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE
+    upload_sessions (
+        id SERIAL PRIMARY KEY,
+        gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+        filename TEXT NOT NULL,
+        byte_size BIGINT NOT NULL,
+        byte_offset BIGINT NOT NULL DEFAULT 0,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        expires_at TIMESTAMPTZ NOT NULL
+    );
+
+CREATE INDEX upload_sessions_gallery_id_idx ON upload_sessions (gallery_id);
+
+CREATE INDEX upload_sessions_expires_at_idx ON upload_sessions (expires_at);
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE upload_sessions;
+
+-- +goose StatementEnd
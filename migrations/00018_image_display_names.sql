@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE images
+ADD COLUMN display_name TEXT NOT NULL DEFAULT '';
+
+UPDATE images
+SET
+    display_name = filename;
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE images
+DROP COLUMN display_name;
+
+-- +goose StatementEnd
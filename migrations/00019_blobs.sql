@@ -0,0 +1,31 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE
+    blobs (
+        sha256 TEXT PRIMARY KEY,
+        storage_key TEXT UNIQUE NOT NULL,
+        byte_size BIGINT NOT NULL,
+        ref_count INT NOT NULL DEFAULT 0,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    );
+
+-- Existing images keep the per-gallery key they were written under until
+-- "reconcile -dedupe" moves them into blobs.
+ALTER TABLE images
+ADD COLUMN storage_key TEXT NOT NULL DEFAULT '';
+
+UPDATE images
+SET
+    storage_key = 'gallery-' || gallery_id || '/' || filename;
+
+CREATE INDEX images_storage_key_idx ON images (storage_key);
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE images
+DROP COLUMN storage_key;
+
+DROP TABLE blobs;
+
+-- +goose StatementEnd
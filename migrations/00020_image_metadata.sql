@@ -0,0 +1,29 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE galleries
+ADD COLUMN keep_gps BOOLEAN NOT NULL DEFAULT false;
+
+CREATE TABLE
+    image_metadata (
+        image_id INT PRIMARY KEY REFERENCES images (id) ON DELETE CASCADE,
+        camera_make TEXT NOT NULL DEFAULT '',
+        camera_model TEXT NOT NULL DEFAULT '',
+        lens TEXT NOT NULL DEFAULT '',
+        exposure_time TEXT NOT NULL DEFAULT '',
+        f_number DOUBLE PRECISION NOT NULL DEFAULT 0,
+        iso INT NOT NULL DEFAULT 0,
+        focal_length DOUBLE PRECISION NOT NULL DEFAULT 0,
+        taken_at TIMESTAMPTZ,
+        latitude DOUBLE PRECISION,
+        longitude DOUBLE PRECISION
+    );
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE image_metadata;
+
+ALTER TABLE galleries
+DROP COLUMN keep_gps;
+
+-- +goose StatementEnd
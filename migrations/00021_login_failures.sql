@@ -0,0 +1,55 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Failed sign ins and lockouts move from users to a table keyed by email.
+-- Recorded on the user, only existing accounts could be locked, so a locked
+-- response told anyone probing an address that it had an account. Keyed by
+-- email, unknown addresses are counted and locked the same way. To see the
+-- lockout of an account, join on its email:
+--
+--   SELECT u.id, f.failed_logins, f.locked_until
+--   FROM users u JOIN login_failures f ON f.email = u.email;
+CREATE TABLE
+    login_failures (
+        email TEXT PRIMARY KEY,
+        failed_logins INT NOT NULL DEFAULT 0,
+        locked_until TIMESTAMPTZ,
+        updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    );
+
+CREATE INDEX login_failures_updated_at_idx ON login_failures (updated_at);
+
+INSERT INTO
+    login_failures (email, failed_logins, locked_until)
+SELECT
+    email,
+    failed_logins,
+    locked_until
+FROM
+    users
+WHERE
+    failed_logins > 0
+    OR locked_until IS NOT NULL;
+
+ALTER TABLE users
+DROP COLUMN failed_logins,
+DROP COLUMN locked_until;
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users
+ADD COLUMN failed_logins INT NOT NULL DEFAULT 0,
+ADD COLUMN locked_until TIMESTAMPTZ;
+
+UPDATE users
+SET
+    failed_logins = login_failures.failed_logins,
+    locked_until = login_failures.locked_until
+FROM
+    login_failures
+WHERE
+    login_failures.email = users.email;
+
+DROP TABLE login_failures;
+
+-- +goose StatementEnd
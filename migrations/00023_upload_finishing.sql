@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Set by the request that receives the last byte of an upload, so retries
+-- of that request do not create the image a second time.
+ALTER TABLE upload_sessions
+ADD COLUMN finishing_at TIMESTAMPTZ;
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE upload_sessions
+DROP COLUMN finishing_at;
+
+-- +goose StatementEnd
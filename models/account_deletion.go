@@ -0,0 +1,129 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	DefaultDeletionGracePeriod = 7 * 24 * time.Hour
+)
+
+// AccountDeletionService schedules accounts for deletion and purges them once
+// the grace period is over. Until then the user can sign in and cancel.
+type AccountDeletionService struct {
+	DB *sql.DB
+	// Galleries removes the gallery files, which the database cascade does
+	// not reach.
+	Galleries *GalleryService
+	// GracePeriod defaults to DefaultDeletionGracePeriod.
+	GracePeriod time.Duration
+}
+
+// Schedule marks userID for deletion and returns when it will happen.
+func (s *AccountDeletionService) Schedule(userID int) (time.Time, error) {
+	grace := s.GracePeriod
+	if grace == 0 {
+		grace = DefaultDeletionGracePeriod
+	}
+	deleteAfter := time.Now().Add(grace)
+	_, err := s.DB.Exec(`UPDATE users SET delete_after=$2 WHERE id=$1`, userID, deleteAfter)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("schedule deletion: %w", err)
+	}
+	return deleteAfter, nil
+}
+
+// Cancel keeps the account. It returns ErrPurging once Purge has started on
+// it, since its galleries may already be gone.
+func (s *AccountDeletionService) Cancel(userID int) error {
+	result, err := s.DB.Exec(`
+	UPDATE users SET delete_after=NULL
+	WHERE id=$1 AND purge_started_at IS NULL`, userID)
+	if err != nil {
+		return fmt.Errorf("cancel deletion: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("cancel deletion: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("cancel deletion: %w", ErrPurging)
+	}
+	return nil
+}
+
+// Purge deletes every account whose grace period is over, together with its
+// galleries and their files. It has the signature of a SweepFunc.
+func (s *AccountDeletionService) Purge() (int64, error) {
+	rows, err := s.DB.Query(`SELECT id FROM users WHERE delete_after <= now()`)
+	if err != nil {
+		return 0, fmt.Errorf("purge accounts: %w", err)
+	}
+	var userIDs []int
+	for rows.Next() {
+		var id int
+		err := rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("purge accounts: %w", err)
+		}
+		userIDs = append(userIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("purge accounts: %w", err)
+	}
+
+	var n int64
+	for _, userID := range userIDs {
+		purged, err := s.purge(userID)
+		if err != nil {
+			// Leave the account for the next run rather than stopping
+			// the others.
+			log.Printf("purge account %d: %v", userID, err)
+			continue
+		}
+		if purged {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *AccountDeletionService) purge(userID int) (bool, error) {
+	// Claim the account before deleting anything so a cancellation that
+	// arrives now cannot leave an account without its galleries. A purge
+	// that fails part way keeps its claim and is retried on the next run.
+	var id int
+	row := s.DB.QueryRow(`
+	UPDATE users SET purge_started_at=now()
+	WHERE id=$1 AND delete_after <= now() RETURNING id`, userID)
+	err := row.Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// Cancelled since Purge listed it.
+			return false, nil
+		}
+		return false, err
+	}
+
+	galleries, err := s.Galleries.ByUserID(userID)
+	if err != nil {
+		return false, err
+	}
+	for _, gallery := range galleries {
+		err = s.Galleries.Delete(gallery.ID)
+		if err != nil {
+			return false, err
+		}
+	}
+	_, err = s.DB.Exec(`DELETE FROM users WHERE id=$1`, userID)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
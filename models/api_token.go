@@ -0,0 +1,161 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	ScopeGalleriesRead  = "galleries:read"
+	ScopeGalleriesWrite = "galleries:write"
+)
+
+// Scopes lists every scope an API token can be granted.
+var Scopes = []string{ScopeGalleriesRead, ScopeGalleriesWrite}
+
+type APIToken struct {
+	ID     int
+	UserID int
+	Name   string
+	// Token is only set when creating a new token. Only store hash in db.
+	Token     string
+	TokenHash string
+	Scopes    []string
+	// LastUsedAt is zero for tokens that were never used.
+	LastUsedAt time.Time
+	CreatedAt  time.Time
+}
+
+func (t APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type APITokenService struct {
+	DB            *sql.DB
+	BytesPerToken int
+}
+
+func (s *APITokenService) Create(userID int, name string, scopes []string) (*APIToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("create api token: name is required")
+	}
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return nil, fmt.Errorf("create api token: unknown scope %q", scope)
+		}
+	}
+
+	newToken, err := newToken(s.BytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create api token: %w", err)
+	}
+	token := APIToken{
+		UserID:    userID,
+		Name:      name,
+		Token:     newToken.Token,
+		TokenHash: newToken.TokenHash,
+		Scopes:    scopes,
+	}
+
+	row := s.DB.QueryRow(`
+	INSERT INTO api_tokens (user_id, name, token_hash, scopes)
+	VALUES ($1, $2, $3, $4) RETURNING id, created_at`,
+		token.UserID, token.Name, token.TokenHash, strings.Join(token.Scopes, " "))
+	err = row.Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("create api token: %w", err)
+	}
+	return &token, nil
+}
+
+// User resolves a bearer token to its user and records that the token was
+// used.
+func (s *APITokenService) User(token string) (*User, *APIToken, error) {
+	var user User
+	apiToken := APIToken{
+		TokenHash: hash(token),
+	}
+	var scopes string
+	var lastUsed, verifiedAt sql.NullTime
+	row := s.DB.QueryRow(`
+	UPDATE api_tokens t SET last_used_at=now()
+	FROM users u
+	WHERE t.token_hash=$1 AND u.id=t.user_id
+	RETURNING t.id, t.name, t.scopes, t.created_at, t.last_used_at, u.id, u.email, u.password_hash, u.email_verified_at`, apiToken.TokenHash)
+	err := row.Scan(&apiToken.ID, &apiToken.Name, &scopes, &apiToken.CreatedAt, &lastUsed,
+		&user.ID, &user.Email, &user.PasswordHash, &verifiedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, fmt.Errorf("user by api token: %w", err)
+	}
+	user.EmailVerifiedAt = verifiedAt.Time
+	apiToken.UserID = user.ID
+	apiToken.Scopes = strings.Fields(scopes)
+	apiToken.LastUsedAt = lastUsed.Time
+	return &user, &apiToken, nil
+}
+
+func (s *APITokenService) ByUserID(userID int) ([]APIToken, error) {
+	rows, err := s.DB.Query(`
+	SELECT id, name, scopes, last_used_at, created_at
+	FROM api_tokens WHERE user_id=$1
+	ORDER BY created_at DESC`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("api tokens by user: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		token := APIToken{
+			UserID: userID,
+		}
+		var scopes string
+		var lastUsed sql.NullTime
+		err := rows.Scan(&token.ID, &token.Name, &scopes, &lastUsed, &token.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("api tokens by user: %w", err)
+		}
+		token.Scopes = strings.Fields(scopes)
+		token.LastUsedAt = lastUsed.Time
+		tokens = append(tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("api tokens by user: %w", err)
+	}
+	return tokens, nil
+}
+
+// Delete revokes a token. The token must belong to userID.
+func (s *APITokenService) Delete(userID, id int) error {
+	var deletedID int
+	row := s.DB.QueryRow(`DELETE FROM api_tokens WHERE id=$1 AND user_id=$2 RETURNING id`, id, userID)
+	err := row.Scan(&deletedID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("delete api token: %w", err)
+	}
+	return nil
+}
+
+func validScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,280 @@
+package models
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+)
+
+// Image contents are stored once per distinct SHA-256 as a blob, shared by
+// every image with the same bytes. The blobs table counts the images that
+// refer to each blob, and the blob is removed from storage when the last one
+// is deleted. Images uploaded before blobs existed keep their per-gallery key
+// until Deduplicate moves them.
+
+const blobsPrefix = "blobs/"
+
+// DedupStats reports how much storage deduplication saves.
+type DedupStats struct {
+	// Blobs is the number of distinct image contents stored.
+	Blobs int64
+	// References is the number of images sharing those blobs.
+	References int64
+	// LogicalBytes is what the images would take up stored separately.
+	LogicalBytes int64
+	// StoredBytes is what the blobs actually take up.
+	StoredBytes int64
+}
+
+// SavedBytes is the storage deduplication avoided.
+func (s DedupStats) SavedBytes() int64 {
+	return s.LogicalBytes - s.StoredBytes
+}
+
+// DedupStats totals the blobs of every gallery.
+func (gs *GalleryService) DedupStats() (DedupStats, error) {
+	var stats DedupStats
+	row := gs.DB.QueryRow(`
+	SELECT COUNT(*), COALESCE(SUM(ref_count), 0),
+		COALESCE(SUM(byte_size * ref_count), 0), COALESCE(SUM(byte_size), 0)
+	FROM blobs WHERE ref_count > 0`)
+	err := row.Scan(&stats.Blobs, &stats.References, &stats.LogicalBytes, &stats.StoredBytes)
+	if err != nil {
+		return DedupStats{}, fmt.Errorf("dedup stats: %w", err)
+	}
+	return stats, nil
+}
+
+// Deduplicate moves the images of a gallery that still have a per-gallery
+// key into blobs, and returns how many it moved.
+func (gs *GalleryService) Deduplicate(galleryID int) (int, error) {
+	images, err := gs.Images(galleryID)
+	if err != nil {
+		return 0, fmt.Errorf("deduplicate gallery %d: %w", galleryID, err)
+	}
+	var moved int
+	for _, image := range images {
+		if isBlobKey(image.Key) {
+			continue
+		}
+		err := gs.moveToBlob(image)
+		if err != nil {
+			return moved, fmt.Errorf("deduplicate gallery %d: %w", galleryID, err)
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+func (gs *GalleryService) moveToBlob(image Image) error {
+	rc, _, err := gs.storage().Get(image.Key)
+	if err != nil {
+		return fmt.Errorf("move %v to blob: %w", image.Key, err)
+	}
+	contents, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return fmt.Errorf("move %v to blob: %w", image.Key, err)
+	}
+	r := bytes.NewReader(contents)
+	// The recorded hash may predate the file, so trust the contents.
+	image.SHA256, image.Size, err = hashContents(r)
+	if err != nil {
+		return fmt.Errorf("move %v to blob: %w", image.Key, err)
+	}
+
+	tx, err := gs.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("move %v to blob: %w", image.Key, err)
+	}
+	defer tx.Rollback()
+
+	key, created, err := acquireBlob(tx, image.SHA256, image.Size)
+	if err != nil {
+		return fmt.Errorf("move %v to blob: %w", image.Key, err)
+	}
+	if created {
+		err = gs.storage().Put(key, r, image.ContentType)
+		if err != nil {
+			return fmt.Errorf("move %v to blob: %w", image.Key, err)
+		}
+	}
+	_, err = tx.Exec(`
+	UPDATE images SET storage_key=$2, sha256=$3, byte_size=$4
+	WHERE id=$1`, image.ID, key, image.SHA256, image.Size)
+	if err != nil {
+		return fmt.Errorf("move %v to blob: %w", image.Key, err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("move %v to blob: %w", image.Key, err)
+	}
+
+	if created {
+		_, err = r.Seek(0, io.SeekStart)
+		if err != nil {
+			return fmt.Errorf("move %v to blob: %w", image.Key, err)
+		}
+		moved := image
+		moved.Key = key
+		logRenditionError(gs.createRenditions(moved, r))
+	}
+	err = gs.deleteStored(image.Key)
+	if err != nil {
+		return fmt.Errorf("move %v to blob: %w", image.Key, err)
+	}
+	return nil
+}
+
+// acquireBlob adds a reference to the blob with the given hash, creating it
+// if needed. created tells the caller to write the contents to key before
+// committing; the blob row stays locked until then, so other uploads of the
+// same contents wait rather than see a blob without a file.
+func acquireBlob(tx *sql.Tx, sum string, size int64) (key string, created bool, err error) {
+	var refCount int
+	row := tx.QueryRow(`
+	INSERT INTO blobs (sha256, storage_key, byte_size, ref_count)
+	VALUES ($1, $2, $3, 1)
+	ON CONFLICT (sha256) DO UPDATE SET ref_count = blobs.ref_count + 1
+	RETURNING storage_key, ref_count`, sum, blobKey(sum), size)
+	err = row.Scan(&key, &refCount)
+	if err != nil {
+		return "", false, fmt.Errorf("acquire blob: %w", err)
+	}
+	return key, refCount == 1, nil
+}
+
+// releaseBlob drops a reference to the object stored under key and reports
+// whether it was the last one, in which case the caller passes key to
+// deleteReleased once the transaction has committed. A rollback then never
+// leaves images pointing at deleted files. Keys that are not blobs have a
+// single owner, so releasing them always reports true.
+func releaseBlob(tx *sql.Tx, key string) (bool, error) {
+	if !isBlobKey(key) {
+		return true, nil
+	}
+	var refCount int
+	row := tx.QueryRow(`
+	UPDATE blobs SET ref_count = ref_count - 1
+	WHERE storage_key=$1 RETURNING ref_count`, key)
+	err := row.Scan(&refCount)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// Nothing tracks the blob, so an upload of the same contents
+			// may be writing it right now; leave the file alone.
+			return false, nil
+		}
+		return false, fmt.Errorf("release blob: %w", err)
+	}
+	return refCount <= 0, nil
+}
+
+// deleteReleased removes the objects released by a committed transaction.
+// The images are gone either way, so failures are only logged; blobs left
+// behind are retried by DeleteUnreferencedBlobs.
+func (gs *GalleryService) deleteReleased(keys []string) {
+	for _, key := range keys {
+		var err error
+		if isBlobKey(key) {
+			_, err = gs.deleteBlob(key)
+		} else {
+			err = gs.deleteStored(key)
+		}
+		if err != nil {
+			log.Printf("delete released %v: %v", key, err)
+		}
+	}
+}
+
+// deleteBlob deletes the blob under key if nothing refers to it any more.
+// Its row is kept until the files are gone and locked meanwhile, so an upload
+// of the same contents either revives the blob first or waits and then writes
+// the file afresh.
+func (gs *GalleryService) deleteBlob(key string) (bool, error) {
+	tx, err := gs.DB.Begin()
+	if err != nil {
+		return false, fmt.Errorf("delete blob: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM blobs WHERE storage_key=$1 AND ref_count <= 0`, key)
+	if err != nil {
+		return false, fmt.Errorf("delete blob: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	err = gs.deleteStored(key)
+	if err != nil {
+		return false, fmt.Errorf("delete blob: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return false, fmt.Errorf("delete blob: %w", err)
+	}
+	return true, nil
+}
+
+// DeleteUnreferencedBlobs deletes blobs whose last image was removed but
+// whose files could not be deleted at the time.
+func (gs *GalleryService) DeleteUnreferencedBlobs() (int64, error) {
+	rows, err := gs.DB.Query(`SELECT storage_key FROM blobs WHERE ref_count <= 0`)
+	if err != nil {
+		return 0, fmt.Errorf("delete unreferenced blobs: %w", err)
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		err := rows.Scan(&key)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("delete unreferenced blobs: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("delete unreferenced blobs: %w", err)
+	}
+
+	var deleted int64
+	for _, key := range keys {
+		ok, err := gs.deleteBlob(key)
+		if err != nil {
+			return deleted, fmt.Errorf("delete unreferenced blobs: %w", err)
+		}
+		if ok {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// deleteStored removes an object and its renditions from storage.
+func (gs *GalleryService) deleteStored(key string) error {
+	err := gs.storage().Delete(key)
+	if err != nil {
+		return fmt.Errorf("delete %v: %w", key, err)
+	}
+	err = gs.deleteRenditions(key)
+	if err != nil {
+		return fmt.Errorf("delete %v: %w", key, err)
+	}
+	return nil
+}
+
+// blobKey spreads blobs over directories by the first byte of their hash so
+// no single directory grows too large.
+func blobKey(sum string) string {
+	return path.Join(blobsPrefix, sum[:2], sum)
+}
+
+func isBlobKey(key string) bool {
+	return strings.HasPrefix(key, blobsPrefix)
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"gopkg.in/gomail.v2"
@@ -8,6 +9,8 @@ import (
 
 const (
 	DefaultSender = "support@goweb.com" // TODO: make better email.
+
+	JobSendEmail = "email.send"
 )
 
 type Email struct {
@@ -34,6 +37,8 @@ func NewEmailService(config SMTPConfig) *EmailService {
 
 type EmailService struct {
 	DefaultSender string
+	// Jobs queues outgoing mail when set, otherwise mail is sent inline.
+	Jobs *JobService
 
 	// unexported fields
 	dialer *gomail.Dialer
@@ -72,13 +77,75 @@ func (es *EmailService) ForgotPassword(to, resetURL string) error {
 		Plaintext: fmt.Sprintf("Click here to reset your password: %s", resetURL),
 		HTML:      fmt.Sprintf(`<a href="%s">Click here to reset your password</a>`, resetURL),
 	}
-	err := es.Send(email)
+	err := es.deliver(email)
 	if err != nil {
 		return fmt.Errorf("forgot password: %w", err)
 	}
 	return nil
 }
 
+func (es *EmailService) VerifyEmail(to, verifyURL string) error {
+	email := Email{
+		To:        to,
+		Subject:   "Verify your email address",
+		Plaintext: fmt.Sprintf("Welcome! Confirm your email address by visiting: %s", verifyURL),
+		HTML:      fmt.Sprintf(`<p>Welcome!</p><p><a href="%s">Click here to confirm your email address</a></p>`, verifyURL),
+	}
+	err := es.deliver(email)
+	if err != nil {
+		return fmt.Errorf("verify email: %w", err)
+	}
+	return nil
+}
+
+func (es *EmailService) ConfirmEmailChange(to, confirmURL string) error {
+	email := Email{
+		To:        to,
+		Subject:   "Confirm your new email address",
+		Plaintext: fmt.Sprintf("Confirm that you want to use this address for your account: %s", confirmURL),
+		HTML:      fmt.Sprintf(`<a href="%s">Click here to confirm your new email address</a>`, confirmURL),
+	}
+	err := es.deliver(email)
+	if err != nil {
+		return fmt.Errorf("confirm email change: %w", err)
+	}
+	return nil
+}
+
+// EmailChangeRequested warns the current address that a change was asked for,
+// in case it was not the account owner.
+func (es *EmailService) EmailChangeRequested(to, newEmail string) error {
+	email := Email{
+		To:        to,
+		Subject:   "Your email address is being changed",
+		Plaintext: fmt.Sprintf("Someone asked to change the email address of your account to %s. If this was not you, reset your password right away.", newEmail),
+	}
+	err := es.deliver(email)
+	if err != nil {
+		return fmt.Errorf("email change requested: %w", err)
+	}
+	return nil
+}
+
+// HandleSendEmailJob is the JobHandler for JobSendEmail.
+func (es *EmailService) HandleSendEmailJob(payload json.RawMessage) error {
+	var email Email
+	err := json.Unmarshal(payload, &email)
+	if err != nil {
+		return fmt.Errorf("decode email job: %w", err)
+	}
+	return es.Send(email)
+}
+
+// deliver queues email for a background worker, or sends it right away if no
+// job queue is configured.
+func (es *EmailService) deliver(email Email) error {
+	if es.Jobs == nil {
+		return es.Send(email)
+	}
+	return es.Jobs.Enqueue(JobSendEmail, email)
+}
+
 func (es *EmailService) setFrom(msg *gomail.Message, email Email) {
 	var from string
 	switch {
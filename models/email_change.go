@@ -0,0 +1,152 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	DefaultEmailChangeDuration = 24 * time.Hour
+)
+
+// EmailChange is a requested new address waiting to be confirmed from that
+// address.
+type EmailChange struct {
+	ID       int
+	UserID   int
+	NewEmail string
+	// Token is only set when creating. Only store hash in db.
+	Token     string
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+type EmailChangeService struct {
+	DB            *sql.DB
+	BytesPerToken int
+	Duration      time.Duration
+}
+
+// Create replaces any pending change for userID. It returns ErrEmailTaken if
+// newEmail already belongs to an account.
+func (s *EmailChangeService) Create(userID int, newEmail string) (*EmailChange, error) {
+	newEmail = strings.ToLower(strings.TrimSpace(newEmail))
+
+	var taken bool
+	row := s.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE email=$1)`, newEmail)
+	err := row.Scan(&taken)
+	if err != nil {
+		return nil, fmt.Errorf("create email change: %w", err)
+	}
+	if taken {
+		return nil, ErrEmailTaken
+	}
+
+	newToken, err := newToken(s.BytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create email change: %w", err)
+	}
+	duration := s.Duration
+	if duration == 0 {
+		duration = DefaultEmailChangeDuration
+	}
+	change := EmailChange{
+		UserID:    userID,
+		NewEmail:  newEmail,
+		Token:     newToken.Token,
+		TokenHash: newToken.TokenHash,
+		ExpiresAt: time.Now().Add(duration),
+	}
+
+	row = s.DB.QueryRow(`INSERT INTO email_changes (user_id, new_email, token_hash, expires_at) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (user_id) DO UPDATE SET new_email=$2, token_hash=$3, expires_at=$4 RETURNING id`,
+		change.UserID, change.NewEmail, change.TokenHash, change.ExpiresAt)
+	err = row.Scan(&change.ID)
+	if err != nil {
+		return nil, fmt.Errorf("create email change: %w", err)
+	}
+	return &change, nil
+}
+
+// Pending returns the unexpired change requested by userID, or ErrNotFound.
+func (s *EmailChangeService) Pending(userID int) (*EmailChange, error) {
+	change := EmailChange{
+		UserID: userID,
+	}
+	row := s.DB.QueryRow(`
+	SELECT id, new_email, expires_at FROM email_changes
+	WHERE user_id=$1 AND expires_at > now()`, userID)
+	err := row.Scan(&change.ID, &change.NewEmail, &change.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("pending email change: %w", err)
+	}
+	return &change, nil
+}
+
+// Consume switches the user to the new address. Following the link proves the
+// address works, so it also counts as verified.
+func (s *EmailChangeService) Consume(token string) (*User, error) {
+	var change EmailChange
+	row := s.DB.QueryRow(`
+	SELECT id, user_id, new_email, expires_at FROM email_changes
+	WHERE token_hash=$1`, hash(token))
+	err := row.Scan(&change.ID, &change.UserID, &change.NewEmail, &change.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("consume email change: %w", ErrTokenInvalid)
+		}
+		return nil, fmt.Errorf("consume email change: %w", err)
+	}
+	if time.Now().After(change.ExpiresAt) {
+		return nil, fmt.Errorf("consume email change: %w", ErrTokenExpired)
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("consume email change: %w", err)
+	}
+	defer tx.Rollback()
+
+	user := User{
+		ID:    change.UserID,
+		Email: change.NewEmail,
+	}
+	row = tx.QueryRow(`
+	UPDATE users SET email=$2, email_verified_at=now()
+	WHERE id=$1 RETURNING password_hash, email_verified_at`, user.ID, user.Email)
+	err = row.Scan(&user.PasswordHash, &user.EmailVerifiedAt)
+	if err != nil {
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) && pgError.Code == pgerrcode.UniqueViolation {
+			return nil, ErrEmailTaken
+		}
+		return nil, fmt.Errorf("consume email change: %w", err)
+	}
+	_, err = tx.Exec(`DELETE FROM email_changes WHERE id=$1`, change.ID)
+	if err != nil {
+		return nil, fmt.Errorf("consume email change: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("consume email change: %w", err)
+	}
+	return &user, nil
+}
+
+// DeleteExpired removes changes that can no longer be confirmed.
+func (s *EmailChangeService) DeleteExpired() (int64, error) {
+	result, err := s.DB.Exec(`DELETE FROM email_changes WHERE expires_at <= now();`)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired: %w", err)
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,99 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultVerificationDuration = 24 * time.Hour
+)
+
+type EmailVerification struct {
+	ID        int
+	UserID    int
+	Token     string
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+type EmailVerificationService struct {
+	DB            *sql.DB
+	BytesPerToken int
+	Duration      time.Duration
+}
+
+// Create issues a verification token for userID, replacing any earlier one.
+func (s *EmailVerificationService) Create(userID int) (*EmailVerification, error) {
+	newToken, err := newToken(s.BytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create email verification: %w", err)
+	}
+	duration := s.Duration
+	if duration == 0 {
+		duration = DefaultVerificationDuration
+	}
+	verification := EmailVerification{
+		UserID:    userID,
+		Token:     newToken.Token,
+		TokenHash: newToken.TokenHash,
+		ExpiresAt: time.Now().Add(duration),
+	}
+
+	row := s.DB.QueryRow(`INSERT INTO email_verifications (user_id, token_hash, expires_at) VALUES ($1, $2, $3)
+	ON CONFLICT (user_id) DO UPDATE SET token_hash=$2, expires_at=$3 RETURNING id`,
+		verification.UserID, verification.TokenHash, verification.ExpiresAt)
+	err = row.Scan(&verification.ID)
+	if err != nil {
+		return nil, fmt.Errorf("create email verification: %w", err)
+	}
+	return &verification, nil
+}
+
+// Consume marks the owner of token as verified and deletes the token.
+func (s *EmailVerificationService) Consume(token string) (*User, error) {
+	tokenHash := hash(token)
+	var user User
+	var verification EmailVerification
+	row := s.DB.QueryRow(`
+	SELECT email_verifications.id, email_verifications.expires_at,
+	users.id, users.email, users.password_hash
+	FROM email_verifications
+	JOIN users ON users.id = email_verifications.user_id
+	WHERE email_verifications.token_hash = $1
+	`, tokenHash)
+	err := row.Scan(&verification.ID, &verification.ExpiresAt, &user.ID, &user.Email, &user.PasswordHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("consume email verification: %w", ErrTokenInvalid)
+		}
+		return nil, fmt.Errorf("consume email verification: %w", err)
+	}
+
+	if time.Now().After(verification.ExpiresAt) {
+		return nil, fmt.Errorf("consume email verification: %w", ErrTokenExpired)
+	}
+
+	row = s.DB.QueryRow(`UPDATE users SET email_verified_at=now() WHERE id=$1 RETURNING email_verified_at`, user.ID)
+	err = row.Scan(&user.EmailVerifiedAt)
+	if err != nil {
+		return nil, fmt.Errorf("consume email verification: %w", err)
+	}
+
+	_, err = s.DB.Exec(`DELETE FROM email_verifications WHERE id=$1`, verification.ID)
+	if err != nil {
+		return nil, fmt.Errorf("consume email verification: %w", err)
+	}
+	return &user, nil
+}
+
+// DeleteExpired removes verification tokens that can no longer be consumed.
+func (s *EmailVerificationService) DeleteExpired() (int64, error) {
+	result, err := s.DB.Exec(`DELETE FROM email_verifications WHERE expires_at <= now();`)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired: %w", err)
+	}
+	return result.RowsAffected()
+}
@@ -3,14 +3,22 @@ package models
 import (
 	"errors"
 	"fmt"
-	"io"
-	"net/http"
 	"path/filepath"
 )
 
 var (
-	ErrEmailTaken = errors.New("models: email address is already taken")
-	ErrNotFound   = errors.New("models: no resource could be found with the provied info")
+	ErrEmailTaken  = errors.New("models: email address is already taken")
+	ErrNotFound    = errors.New("models: no resource could be found with the provied info")
+	ErrInvalidCode = errors.New("models: invalid two-factor code")
+	ErrImageExists = errors.New("models: an image with that name already exists")
+	ErrPurging     = errors.New("models: account deletion has already started")
+	ErrFinishing   = errors.New("models: upload is already being finished")
+
+	// ErrInvalidCredentials covers both an unknown email and a wrong
+	// password so callers cannot tell which accounts exist.
+	ErrInvalidCredentials = errors.New("models: invalid email or password")
+	ErrTokenExpired       = errors.New("models: token has expired")
+	ErrTokenInvalid       = errors.New("models: token is invalid")
 )
 
 type FileError struct {
@@ -21,31 +29,6 @@ func (fe FileError) Error() string {
 	return fmt.Sprintf("invalid file: %v", fe.Issue)
 }
 
-func checkContentType(r io.ReadSeeker, allowedTypes []string) error {
-	testBytes := make([]byte, 512)
-	_, err := r.Read(testBytes)
-	if err != nil {
-		return fmt.Errorf("checking content type: %w", err)
-	}
-	_, err = r.Seek(0, 0)
-	if err != nil {
-		return fmt.Errorf("checking content type: %w", err)
-	}
-
-	contentType := http.DetectContentType(testBytes)
-
-	for _, t := range allowedTypes {
-		if contentType == t {
-			return nil
-		}
-	}
-
-	return FileError{
-		Issue: fmt.Sprintf("invalid content type: %v", err),
-	}
-
-}
-
 func checkExtension(filename string, allowedExtensions []string) error {
 	if hasExtension(filename, allowedExtensions) {
 		return nil
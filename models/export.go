@@ -0,0 +1,190 @@
+package models
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ExportManifest is written to manifest.json at the root of an export. It
+// describes every gallery and where its images are in the archive.
+type ExportManifest struct {
+	ExportedAt time.Time       `json:"exported_at"`
+	Galleries  []ExportGallery `json:"galleries"`
+}
+
+type ExportGallery struct {
+	ID         int           `json:"id"`
+	Title      string        `json:"title"`
+	Visibility string        `json:"visibility"`
+	Folder     string        `json:"folder"`
+	Images     []ExportImage `json:"images"`
+}
+
+type ExportImage struct {
+	Path        string    `json:"path"`
+	Filename    string    `json:"filename"`
+	DisplayName string    `json:"display_name"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	SHA256      string    `json:"sha256"`
+	Caption     string    `json:"caption"`
+	Position    int       `json:"position"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+}
+
+// Export streams a zip of every gallery owned by userID to w: a manifest.json
+// followed by the original images, one folder per gallery. Renditions are
+// left out since they can be regenerated.
+func (gs *GalleryService) Export(w io.Writer, userID int) error {
+	galleries, err := gs.ByUserID(userID)
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+
+	manifest := ExportManifest{
+		ExportedAt: time.Now().UTC(),
+		Galleries:  []ExportGallery{},
+	}
+	var images [][]Image
+	for _, gallery := range galleries {
+		galleryImages, err := gs.Images(gallery.ID)
+		if err != nil {
+			return fmt.Errorf("export: %w", err)
+		}
+		images = append(images, galleryImages)
+		manifest.Galleries = append(manifest.Galleries, newExportGallery(gallery, galleryImages))
+	}
+
+	zw := zip.NewWriter(w)
+	mw, err := zw.Create("manifest.json")
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	enc := json.NewEncoder(mw)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(manifest)
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+
+	for i, gallery := range manifest.Galleries {
+		for j, image := range images[i] {
+			err = gs.addToZip(zw, gallery.Images[j].Path, image)
+			if err != nil {
+				return fmt.Errorf("export: %w", err)
+			}
+		}
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	return nil
+}
+
+// WriteZip streams a zip of images to w without buffering it anywhere. The
+// images are stored at the root of the archive under their filenames.
+func (gs *GalleryService) WriteZip(w io.Writer, images []Image) error {
+	zw := zip.NewWriter(w)
+	for _, image := range images {
+		err := gs.addToZip(zw, path.Base(image.Filename), image)
+		if err != nil {
+			return fmt.Errorf("write zip: %w", err)
+		}
+	}
+	err := zw.Close()
+	if err != nil {
+		return fmt.Errorf("write zip: %w", err)
+	}
+	return nil
+}
+
+func newExportGallery(gallery Gallery, images []Image) ExportGallery {
+	eg := ExportGallery{
+		ID:         gallery.ID,
+		Title:      gallery.Title,
+		Visibility: gallery.Visibility,
+		Folder:     gallery.ArchiveName(),
+		Images:     []ExportImage{},
+	}
+	for _, image := range images {
+		eg.Images = append(eg.Images, ExportImage{
+			Path:        path.Join(eg.Folder, path.Base(image.Filename)),
+			Filename:    image.Filename,
+			DisplayName: image.DisplayName,
+			ContentType: image.ContentType,
+			Size:        image.Size,
+			Width:       image.Width,
+			Height:      image.Height,
+			SHA256:      image.SHA256,
+			Caption:     image.Caption,
+			Position:    image.Position,
+			UploadedAt:  image.UploadedAt,
+		})
+	}
+	return eg
+}
+
+// addToZip copies image into zw under name. Images are already compressed,
+// so they are stored as is. An image missing from storage is skipped rather
+// than failing the whole archive.
+func (gs *GalleryService) addToZip(zw *zip.Writer, name string, image Image) error {
+	rc, _, err := gs.Open(image)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			log.Printf("zip: %s missing from storage, skipping", image.Key)
+			return nil
+		}
+		return err
+	}
+	defer rc.Close()
+
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: image.UploadedAt,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, rc)
+	return err
+}
+
+// ArchiveName names gallery in archives, e.g. "12-summer-holiday". The ID
+// keeps names unique and the rest is safe in any file system.
+func (gallery Gallery) ArchiveName() string {
+	var sb strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(gallery.Title) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			sb.WriteRune(r)
+			dash = false
+			continue
+		}
+		if !dash && sb.Len() > 0 {
+			sb.WriteByte('-')
+			dash = true
+		}
+	}
+	name := strings.TrimSuffix(sb.String(), "-")
+	if len(name) > 50 {
+		name = strings.ToValidUTF8(name[:50], "")
+		name = strings.TrimSuffix(name, "-")
+	}
+	if name == "" {
+		return fmt.Sprint(gallery.ID)
+	}
+	return fmt.Sprintf("%d-%s", gallery.ID, name)
+}
@@ -0,0 +1,146 @@
+package models
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// CollisionPolicy decides what happens when an upload has the same name as an
+// image already in the gallery.
+type CollisionPolicy string
+
+const (
+	// CollisionRename numbers the new image, e.g. "IMG_0001-1.jpg".
+	CollisionRename CollisionPolicy = "rename"
+	// CollisionReject refuses the upload with ErrImageExists.
+	CollisionReject CollisionPolicy = "reject"
+	// CollisionReplace overwrites the existing image.
+	CollisionReplace CollisionPolicy = "replace"
+
+	// maxRenameAttempts bounds how often CollisionRename retries when
+	// concurrent uploads keep claiming the name it picked.
+	maxRenameAttempts = 10
+)
+
+// ValidCollisionPolicy reports whether p is a known collision policy.
+func ValidCollisionPolicy(p CollisionPolicy) bool {
+	switch p {
+	case CollisionRename, CollisionReject, CollisionReplace:
+		return true
+	}
+	return false
+}
+
+func (gs *GalleryService) collisionPolicy() CollisionPolicy {
+	if gs.Collisions == "" {
+		return CollisionRename
+	}
+	return gs.Collisions
+}
+
+// maxFilenameBytes keeps stored names within the limit of common file
+// systems and object stores, with room for a collision suffix.
+const maxFilenameBytes = 200
+
+// maxExtensionBytes is the longest extension, dot included, that is kept.
+// Longer ones are not image extensions and are dropped.
+const maxExtensionBytes = 16
+
+// reservedNames cannot be used as file names on Windows, with or without an
+// extension, so archives containing them would fail to extract there.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// DisplayName cleans up an uploaded file name for showing to people. It keeps
+// the name as the user wrote it, minus any directories, invisible characters
+// and differences in Unicode normalization.
+func DisplayName(name string) string {
+	name = strings.ToValidUTF8(name, "")
+	name = norm.NFC.String(name)
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+// SanitizeFilename turns an uploaded file name into the name an image is
+// stored and addressed by. The result is safe in URLs, zip archives and on any
+// common file system. It returns "" when nothing usable is left.
+func SanitizeFilename(name string) string {
+	name = DisplayName(name)
+
+	var sb strings.Builder
+	lastDash := false
+	for _, r := range name {
+		switch {
+		case r == '.' || r == '_' || r == '-':
+			sb.WriteRune(r)
+			lastDash = false
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r):
+			sb.WriteRune(r)
+			lastDash = false
+		default:
+			// Spaces, punctuation and symbols collapse into single dashes.
+			if !lastDash {
+				sb.WriteByte('-')
+				lastDash = true
+			}
+		}
+	}
+
+	stem, ext := splitExt(sb.String())
+	stem = strings.Trim(stem, ".-_ ")
+	ext = strings.ToLower(strings.Trim(ext, "-"))
+	if len(ext) > maxExtensionBytes {
+		ext = ""
+	}
+	if stem == "" {
+		return ""
+	}
+	if reservedNames[strings.ToUpper(stem)] {
+		stem = "_" + stem
+	}
+	for stem != "" && len(stem)+len(ext) > maxFilenameBytes {
+		_, size := utf8.DecodeLastRuneInString(stem)
+		stem = stem[:len(stem)-size]
+	}
+	if stem == "" {
+		return ""
+	}
+	return stem + ext
+}
+
+// numberedFilename returns name with n added before the extension, e.g.
+// "IMG_0001-2.jpg".
+func numberedFilename(name string, n int) string {
+	stem, ext := splitExt(name)
+	return stem + "-" + strconv.Itoa(n) + ext
+}
+
+// splitExt splits name into everything before its final extension and the
+// extension itself, including the dot.
+func splitExt(name string) (string, string) {
+	ext := path.Ext(name)
+	if ext == name {
+		return name, ""
+	}
+	return strings.TrimSuffix(name, ext), ext
+}
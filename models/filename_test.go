@@ -0,0 +1,33 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"IMG_0001.JPG", "IMG_0001.jpg"},
+		{"../../etc/passwd", "passwd"},
+		{"my holiday photo!.png", "my-holiday-photo.png"},
+		{"CON.jpg", "_CON.jpg"},
+		{"...", ""},
+		{strings.Repeat("a", 250) + ".jpg", strings.Repeat("a", 196) + ".jpg"},
+		// An extension too long to be real is dropped rather than kept at
+		// the expense of the stem.
+		{"x." + strings.Repeat("a", 250), "x"},
+		{strings.Repeat("b", 300) + "." + strings.Repeat("a", 300), strings.Repeat("b", 200)},
+	}
+	for _, tt := range tests {
+		got := SanitizeFilename(tt.name)
+		if got != tt.want {
+			t.Errorf("SanitizeFilename(%.40q) = %.40q, want %.40q", tt.name, got, tt.want)
+		}
+		if len(got) > maxFilenameBytes {
+			t.Errorf("SanitizeFilename(%.40q) is %d bytes long", tt.name, len(got))
+		}
+	}
+}
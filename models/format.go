@@ -0,0 +1,148 @@
+package models
+
+import (
+	"example/web-go/imaging"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultMaxPixels is the largest image, in pixels, accepted when
+// GalleryService.MaxPixels is unset. It leaves room for panoramas and
+// medium format cameras while keeping a decoded image within a few hundred
+// megabytes.
+const DefaultMaxPixels = 100_000_000
+
+// DefaultFormats are the image formats accepted when GalleryService.Formats
+// is empty. HEIC is left out since most browsers cannot display it; iPhones
+// convert photos to JPEG when a site does not ask for HEIC.
+var DefaultFormats = []string{"jpeg", "png", "gif", "webp", "avif"}
+
+// ValidFormat reports whether name is a format uploads can be allowed in.
+func ValidFormat(name string) bool {
+	_, ok := imaging.FormatByName(name)
+	return ok
+}
+
+// AllowedFormats lists the formats images may be uploaded in.
+func (gs *GalleryService) AllowedFormats() []imaging.Format {
+	names := gs.Formats
+	if len(names) == 0 {
+		names = DefaultFormats
+	}
+	var formats []imaging.Format
+	for _, name := range names {
+		if f, ok := imaging.FormatByName(name); ok {
+			formats = append(formats, f)
+		}
+	}
+	return formats
+}
+
+// extensions lists the extensions an upload may have before its contents
+// are known. Every known format counts, since a photo named .heic is often
+// a JPEG by the time it is uploaded; checkFormat decides on the contents.
+func (gs *GalleryService) extensions() []string {
+	var extensions []string
+	for _, f := range imaging.Formats {
+		extensions = append(extensions, f.Extensions...)
+	}
+	return extensions
+}
+
+// checkFormat sniffs the format of r, rewinds it and returns the format if it
+// is one of allowed.
+func checkFormat(r io.ReadSeeker, allowed []imaging.Format) (imaging.Format, error) {
+	testBytes := make([]byte, 512)
+	n, err := io.ReadFull(r, testBytes)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return imaging.Format{}, fmt.Errorf("checking format: %w", err)
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return imaging.Format{}, fmt.Errorf("checking format: %w", err)
+	}
+
+	format, ok := imaging.Sniff(testBytes[:n])
+	if !ok {
+		return imaging.Format{}, FileError{
+			Issue: fmt.Sprintf("invalid content type: %v", http.DetectContentType(testBytes[:n])),
+		}
+	}
+	for _, f := range allowed {
+		if f.Name == format.Name {
+			return format, nil
+		}
+	}
+	return imaging.Format{}, FileError{
+		Issue: fmt.Sprintf("invalid content type: %v", format.ContentType),
+	}
+}
+
+// formatFilename gives filename the extension of the format its contents
+// are in, so "IMG_0001.HEIC" holding a JPEG is saved as "IMG_0001.jpg".
+// Names that already have one of the format's extensions are kept.
+func formatFilename(filename string, format imaging.Format) string {
+	if format.HasExtension(filename) {
+		return filename
+	}
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + format.Extension()
+}
+
+func (gs *GalleryService) maxPixels() int64 {
+	if gs.MaxPixels <= 0 {
+		return DefaultMaxPixels
+	}
+	return gs.MaxPixels
+}
+
+// checkPixels refuses images too large to decode safely. The header of an
+// image is enough to make a decoder allocate its full size, so this runs
+// before anything decodes the pixels.
+func (gs *GalleryService) checkPixels(width, height int) error {
+	if int64(width)*int64(height) > gs.maxPixels() {
+		return FileError{
+			Issue: fmt.Sprintf("image is too large: %dx%d pixels", width, height),
+		}
+	}
+	return nil
+}
+
+// imageDimensions reads the image header from r, checks the size against
+// MaxPixels and rewinds r. Formats that cannot be decoded have their size
+// read from the container.
+func (gs *GalleryService) imageDimensions(r io.ReadSeeker, format imaging.Format) (int, int, error) {
+	var width, height int
+	if format.Decode {
+		config, _, err := image.DecodeConfig(r)
+		if err != nil {
+			return 0, 0, FileError{
+				Issue: fmt.Sprintf("unreadable image: %v", err),
+			}
+		}
+		width, height = config.Width, config.Height
+	} else {
+		contents, err := io.ReadAll(r)
+		if err != nil {
+			return 0, 0, fmt.Errorf("image dimensions: %w", err)
+		}
+		width, height, err = imaging.HEIFSize(contents)
+		if err != nil {
+			return 0, 0, FileError{
+				Issue: fmt.Sprintf("unreadable image: %v", err),
+			}
+		}
+	}
+	_, err := r.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, 0, fmt.Errorf("image dimensions: %w", err)
+	}
+	err = gs.checkPixels(width, height)
+	if err != nil {
+		return 0, 0, err
+	}
+	return width, height, nil
+}
@@ -1,37 +1,102 @@
 package models
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
+	"example/web-go/imaging"
+	"example/web-go/rand"
+	"example/web-go/storage"
 	"fmt"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
-	"io/fs"
-	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type Image struct {
+	ID        int
 	GalleryID int
-	Path      string
-	Filename  string
+	// Key locates the image in the GalleryService storage.
+	Key string
+	// Filename is the sanitized name the image is stored and addressed by.
+	Filename string
+	// DisplayName is the name the image was uploaded with.
+	DisplayName string
+	ContentType string
+	Size        int64
+	Width       int
+	Height      int
+	SHA256      string
+	Caption     string
+	UploadedAt  time.Time
+	Position    int
+	// EXIF is the camera metadata of the photo, if it had any. It is only
+	// set by CreateImage; ImageMetadata loads it for existing images.
+	EXIF *imaging.EXIF
 }
 
 type Gallery struct {
 	ID     int
 	UserID int
 	Title  string
+	// Visibility is one of VisibilityPrivate, VisibilityUnlisted or
+	// VisibilityPublic.
+	Visibility string
+	// Slug is the random identifier unlisted galleries are reached by.
+	Slug string
+	// KeepGPS keeps the location in photos uploaded to the gallery. It is
+	// stripped by default.
+	KeepGPS bool
+}
+
+const (
+	VisibilityPrivate  = "private"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPublic   = "public"
+
+	BytesPerSlug = 12
+)
+
+// ValidVisibility reports whether v is a known gallery visibility.
+func ValidVisibility(v string) bool {
+	switch v {
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+		return true
+	}
+	return false
 }
 
 type GalleryService struct {
-	DB        *sql.DB
-	ImagesDir string
+	DB *sql.DB
+	// Storage holds the image files. Defaults to a local store in "images".
+	Storage storage.Store
+	// Jobs queues rendition generation when set, otherwise it runs inline.
+	Jobs *JobService
+	// Collisions decides what happens when an upload has the name of an
+	// existing image. Defaults to CollisionRename.
+	Collisions CollisionPolicy
+	// ZipLimits bounds archives unpacked by ImportZip.
+	ZipLimits ZipLimits
+	// Formats names the image formats uploads may use. Defaults to
+	// DefaultFormats.
+	Formats []string
+	// MaxPixels caps the width times height of images, which bounds the
+	// memory decoding them takes. Defaults to DefaultMaxPixels.
+	MaxPixels int64
 }
 
 func (gs *GalleryService) Create(title string, userID int) (*Gallery, error) {
 	gallery := Gallery{
-		Title:  title,
-		UserID: userID,
+		Title:      title,
+		UserID:     userID,
+		Visibility: VisibilityPrivate,
 	}
 
 	row := gs.DB.QueryRow(`
@@ -54,10 +119,10 @@ func (gs *GalleryService) ByID(id int) (*Gallery, error) {
 	}
 
 	row := gs.DB.QueryRow(`
-	SELECT title, user_id FROM galleries WHERE id=$1;
+	SELECT title, user_id, visibility, COALESCE(slug, ''), keep_gps FROM galleries WHERE id=$1;
 	`, id)
 
-	err := row.Scan(&gallery.Title, &gallery.UserID)
+	err := row.Scan(&gallery.Title, &gallery.UserID, &gallery.Visibility, &gallery.Slug, &gallery.KeepGPS)
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -69,8 +134,52 @@ func (gs *GalleryService) ByID(id int) (*Gallery, error) {
 	return &gallery, nil
 }
 
+func (gs *GalleryService) BySlug(slug string) (*Gallery, error) {
+	gallery := Gallery{
+		Slug: slug,
+	}
+
+	row := gs.DB.QueryRow(`
+	SELECT id, title, user_id, visibility, keep_gps FROM galleries WHERE slug=$1;
+	`, slug)
+
+	err := row.Scan(&gallery.ID, &gallery.Title, &gallery.UserID, &gallery.Visibility, &gallery.KeepGPS)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query gallery by slug: %w", err)
+	}
+
+	return &gallery, nil
+}
+
+func (gs *GalleryService) All() ([]Gallery, error) {
+	rows, err := gs.DB.Query(`SELECT id, user_id, title, visibility, COALESCE(slug, ''), keep_gps FROM galleries ORDER BY id;`)
+	if err != nil {
+		return nil, fmt.Errorf("query all galleries: %w", err)
+	}
+	defer rows.Close()
+
+	var galleries []Gallery
+	for rows.Next() {
+		var gallery Gallery
+		err := rows.Scan(&gallery.ID, &gallery.UserID, &gallery.Title, &gallery.Visibility, &gallery.Slug, &gallery.KeepGPS)
+		if err != nil {
+			return nil, fmt.Errorf("query all galleries: %w", err)
+		}
+		galleries = append(galleries, gallery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query all galleries: %w", err)
+	}
+
+	return galleries, nil
+}
+
 func (gs *GalleryService) ByUserID(userID int) ([]Gallery, error) {
-	rows, err := gs.DB.Query(`SELECT id, title FROM galleries WHERE user_id=$1;`, userID)
+	rows, err := gs.DB.Query(`SELECT id, title, visibility, COALESCE(slug, ''), keep_gps FROM galleries WHERE user_id=$1;`, userID)
 
 	if err != nil {
 		return nil, fmt.Errorf("query galleries by user: %w", err)
@@ -82,7 +191,7 @@ func (gs *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 		gallery := Gallery{
 			UserID: userID,
 		}
-		err := rows.Scan(&gallery.ID, &gallery.Title)
+		err := rows.Scan(&gallery.ID, &gallery.Title, &gallery.Visibility, &gallery.Slug, &gallery.KeepGPS)
 
 		if err != nil {
 			return nil, fmt.Errorf("query galleries by user: %w", err)
@@ -97,13 +206,27 @@ func (gs *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 	return galleries, nil
 }
 
-func (gs *GalleryService) Update(gallary Gallery) error {
+// Update saves the title, visibility and GPS setting of the gallery.
+// Galleries made unlisted get a slug the first time; it is kept afterwards so
+// links that were already shared keep working if the gallery is unlisted
+// again.
+func (gs *GalleryService) Update(gallary *Gallery) error {
+	if !ValidVisibility(gallary.Visibility) {
+		return fmt.Errorf("update gallery: invalid visibility %q", gallary.Visibility)
+	}
+	if gallary.Visibility == VisibilityUnlisted && gallary.Slug == "" {
+		slug, err := rand.String(BytesPerSlug)
+		if err != nil {
+			return fmt.Errorf("update gallery: %w", err)
+		}
+		gallary.Slug = slug
+	}
 
 	_, err := gs.DB.Exec(`
 	UPDATE galleries 
-	SET title=$2
+	SET title=$2, visibility=$3, slug=NULLIF($4, ''), keep_gps=$5
 	WHERE id=$1
-	`, gallary.ID, gallary.Title)
+	`, gallary.ID, gallary.Title, gallary.Visibility, gallary.Slug, gallary.KeepGPS)
 
 	if err != nil {
 		return fmt.Errorf("update gallery: %w", err)
@@ -112,14 +235,60 @@ func (gs *GalleryService) Update(gallary Gallery) error {
 	return nil
 }
 
+// Delete removes a gallery with its images. Blobs are only removed from
+// storage when no other gallery shares them.
 func (gs *GalleryService) Delete(id int) error {
+	tx, err := gs.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("delete gallery: %w", err)
+	}
+	defer tx.Rollback()
 
-	_, err := gs.DB.Exec(`DELETE FROM galleries WHERE id=$1`, id)
+	rows, err := tx.Query(`
+	DELETE FROM images WHERE gallery_id=$1 RETURNING storage_key`, id)
+	if err != nil {
+		return fmt.Errorf("delete gallery: %w", err)
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		err := rows.Scan(&key)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("delete gallery: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("delete gallery: %w", err)
+	}
 
+	var released []string
+	for _, key := range keys {
+		if !isBlobKey(key) {
+			// Removed with the rest of the gallery prefix below.
+			continue
+		}
+		last, err := releaseBlob(tx, key)
+		if err != nil {
+			return fmt.Errorf("delete gallery: %w", err)
+		}
+		if last {
+			released = append(released, key)
+		}
+	}
+	_, err = tx.Exec(`DELETE FROM galleries WHERE id=$1`, id)
 	if err != nil {
 		return fmt.Errorf("delete gallery: %w", err)
 	}
-	err = os.RemoveAll(gs.galleryDir(id))
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("delete gallery: %w", err)
+	}
+	gs.deleteReleased(released)
+
+	err = storage.DeletePrefix(gs.storage(), gs.galleryPrefix(id))
 	if err != nil {
 		return fmt.Errorf("delete gallery: %w", err)
 	}
@@ -127,67 +296,266 @@ func (gs *GalleryService) Delete(id int) error {
 }
 
 func (gs *GalleryService) Images(galleryID int) ([]Image, error) {
-	globPattern := filepath.Join(gs.galleryDir(galleryID), "*")
-	allFiles, err := filepath.Glob(globPattern)
+	rows, err := gs.DB.Query(`
+	SELECT id, storage_key, filename, display_name, content_type, byte_size, width, height, sha256, caption, uploaded_at, position
+	FROM images
+	WHERE gallery_id=$1
+	ORDER BY position, id;
+	`, galleryID)
 	if err != nil {
 		return nil, fmt.Errorf("getting gallery images: %w", err)
 	}
+	defer rows.Close()
+
 	var images []Image
-	for _, file := range allFiles {
-		if hasExtension(file, gs.extensions()) {
-			images = append(images, Image{
-				GalleryID: galleryID,
-				Path:      file,
-				Filename:  filepath.Base(file),
-			})
+	for rows.Next() {
+		image := Image{
+			GalleryID: galleryID,
+		}
+		err := rows.Scan(&image.ID, &image.Key, &image.Filename, &image.DisplayName, &image.ContentType, &image.Size,
+			&image.Width, &image.Height, &image.SHA256, &image.Caption, &image.UploadedAt, &image.Position)
+		if err != nil {
+			return nil, fmt.Errorf("getting gallery images: %w", err)
 		}
+		images = append(images, image)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("getting gallery images: %w", err)
 	}
 
 	return images, nil
 }
 
 func (gs *GalleryService) Image(galleryID int, filename string) (Image, error) {
-	imagePath := filepath.Join(gs.galleryDir(galleryID), filename)
-	_, err := os.Stat(imagePath)
+	image := Image{
+		GalleryID: galleryID,
+		Filename:  filename,
+	}
+
+	row := gs.DB.QueryRow(`
+	SELECT id, storage_key, display_name, content_type, byte_size, width, height, sha256, caption, uploaded_at, position
+	FROM images
+	WHERE gallery_id=$1 AND filename=$2;
+	`, galleryID, filename)
+	err := row.Scan(&image.ID, &image.Key, &image.DisplayName, &image.ContentType, &image.Size, &image.Width, &image.Height,
+		&image.SHA256, &image.Caption, &image.UploadedAt, &image.Position)
 	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) {
+		if errors.Is(err, sql.ErrNoRows) {
 			return Image{}, ErrNotFound
 		}
 		return Image{}, fmt.Errorf("querying for image: %w", err)
 	}
 
-	return Image{Filename: filename, GalleryID: galleryID, Path: imagePath}, nil
+	return image, nil
 }
 
-func (gs *GalleryService) CreateImage(galleryID int, filename string, contents io.ReadSeeker) error {
+// CreateImage validates contents and adds it to a gallery. The image is
+// stored under a sanitized version of filename, which the collision policy
+// may number to keep an existing image; the returned Image has the final name.
+func (gs *GalleryService) CreateImage(galleryID int, filename string, contents io.ReadSeeker) (Image, error) {
+	image := Image{
+		GalleryID:   galleryID,
+		Filename:    SanitizeFilename(filename),
+		DisplayName: DisplayName(filename),
+	}
+	if image.Filename == "" {
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, FileError{Issue: "invalid file name"})
+	}
+
+	err := checkExtension(image.Filename, gs.extensions())
+	if err != nil {
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	format, err := checkFormat(contents, gs.AllowedFormats())
+	if err != nil {
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	image.ContentType = format.ContentType
+	image.Filename = formatFilename(image.Filename, format)
+	// Checked before cleaning, which decodes JPEGs that need rotating.
+	image.Width, image.Height, err = gs.imageDimensions(contents, format)
+	if err != nil {
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	if format.Name == imaging.JPEG.Name {
+		contents, image.EXIF, err = gs.cleanJPEG(galleryID, contents)
+		if err == nil {
+			// Turning the photo upright may have swapped its sides.
+			image.Width, image.Height, err = gs.imageDimensions(contents, format)
+		}
+	} else {
+		contents, err = gs.stripLocation(galleryID, contents, format)
+	}
+	if err != nil {
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+	}
 
-	err := checkContentType(contents, gs.imageContentTypes())
+	image.SHA256, image.Size, err = hashContents(contents)
 	if err != nil {
-		return fmt.Errorf("creating image %v: %w", filename, err)
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
 	}
-	err = checkExtension(filename, gs.extensions())
+
+	created, err := gs.storeImage(&image, contents)
 	if err != nil {
-		return fmt.Errorf("creating image %v: %w", filename, err)
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	if !created {
+		// The contents were already stored, renditions included.
+		return image, nil
+	}
+
+	if gs.Jobs != nil {
+		err = gs.Jobs.Enqueue(JobImageRenditions, renditionsJob{GalleryID: galleryID, Filename: image.Filename})
+		if err != nil {
+			return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+		}
+		return image, nil
 	}
 
-	galleryDir := gs.galleryDir(galleryID)
-	err = os.MkdirAll(galleryDir, 0755)
+	_, err = contents.Seek(0, io.SeekStart)
 	if err != nil {
-		return fmt.Errorf("creating gallery-%d images directory: %w", galleryID, err)
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
 	}
-	imagePath := filepath.Join(galleryDir, filename)
-	dst, err := os.Create(imagePath)
+	logRenditionError(gs.createRenditions(image, contents))
+
+	return image, nil
+}
+
+// storeImage claims a filename for image according to the collision policy
+// and stores contents as its blob. It reports whether the blob is new, as
+// opposed to shared with an image that has the same contents.
+func (gs *GalleryService) storeImage(image *Image, contents io.ReadSeeker) (bool, error) {
+	policy := gs.collisionPolicy()
+	base := image.Filename
+	for attempt := 0; attempt < maxRenameAttempts; attempt++ {
+		if policy == CollisionRename {
+			name, err := gs.freeFilename(image.GalleryID, base)
+			if err != nil {
+				return false, err
+			}
+			image.Filename = name
+		}
+		stored, created, err := gs.putImage(image, contents, policy == CollisionReplace)
+		if err != nil {
+			return false, err
+		}
+		if stored {
+			return created, nil
+		}
+		if policy == CollisionReject {
+			return false, ErrImageExists
+		}
+		// Another upload claimed the name after freeFilename looked.
+	}
+	return false, fmt.Errorf("no free filename for %v", base)
+}
+
+// putImage inserts the row for image and references its blob in one
+// transaction, writing the blob if it is new. The row stays invisible until
+// the file is complete, and a concurrent upload of the same name waits for it
+// instead of taking the name too. It reports false without writing anything
+// if the name is taken and replace is unset.
+func (gs *GalleryService) putImage(image *Image, contents io.ReadSeeker, replace bool) (stored, created bool, err error) {
+	tx, err := gs.DB.Begin()
 	if err != nil {
-		return fmt.Errorf("creating image file: %w", err)
+		return false, false, fmt.Errorf("put image: %w", err)
 	}
-	defer dst.Close()
+	defer tx.Rollback()
 
-	_, err = io.Copy(dst, contents)
+	var replaced string
+	if replace {
+		replaced, err = storageKey(tx, image.GalleryID, image.Filename)
+		if err != nil {
+			return false, false, fmt.Errorf("put image: %w", err)
+		}
+	}
+
+	image.Key, created, err = acquireBlob(tx, image.SHA256, image.Size)
+	if err != nil {
+		return false, false, fmt.Errorf("put image: %w", err)
+	}
+	inserted, err := insertImage(tx, image, replace)
+	if err != nil || !inserted {
+		return false, false, err
+	}
+	err = saveMetadata(tx, image)
 	if err != nil {
-		return fmt.Errorf("copying contents to image: %w", err)
+		return false, false, fmt.Errorf("put image: %w", err)
 	}
 
-	return nil
+	if created {
+		_, err = contents.Seek(0, io.SeekStart)
+		if err != nil {
+			return false, false, fmt.Errorf("put image: %w", err)
+		}
+		err = gs.storage().Put(image.Key, contents, image.ContentType)
+		if err != nil {
+			return false, false, fmt.Errorf("put image: %w", err)
+		}
+	}
+	var last bool
+	if replaced != "" {
+		last, err = releaseBlob(tx, replaced)
+		if err != nil {
+			return false, false, fmt.Errorf("put image: %w", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return false, false, fmt.Errorf("put image: %w", err)
+	}
+	if last {
+		gs.deleteReleased([]string{replaced})
+	}
+	return true, created, nil
+}
+
+// storageKey returns the key of an image locked for update, or "" if the
+// gallery has no image by that name.
+func storageKey(tx *sql.Tx, galleryID int, filename string) (string, error) {
+	var key string
+	row := tx.QueryRow(`
+	SELECT storage_key FROM images
+	WHERE gallery_id=$1 AND filename=$2 FOR UPDATE`, galleryID, filename)
+	err := row.Scan(&key)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", fmt.Errorf("storage key: %w", err)
+	}
+	return key, nil
+}
+
+// freeFilename returns name, or name numbered with the lowest suffix that is
+// not used by an image in the gallery yet.
+func (gs *GalleryService) freeFilename(galleryID int, name string) (string, error) {
+	stem, _ := splitExt(name)
+	rows, err := gs.DB.Query(`
+	SELECT filename FROM images
+	WHERE gallery_id=$1 AND starts_with(filename, $2)`, galleryID, stem)
+	if err != nil {
+		return "", fmt.Errorf("free filename: %w", err)
+	}
+	defer rows.Close()
+	taken := make(map[string]bool)
+	for rows.Next() {
+		var filename string
+		err := rows.Scan(&filename)
+		if err != nil {
+			return "", fmt.Errorf("free filename: %w", err)
+		}
+		taken[filename] = true
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("free filename: %w", err)
+	}
+
+	candidate := name
+	for n := 1; taken[candidate]; n++ {
+		candidate = numberedFilename(name, n)
+	}
+	return candidate, nil
 }
 
 func (gs *GalleryService) DeleteImage(galleryID int, filename string) error {
@@ -197,26 +565,235 @@ func (gs *GalleryService) DeleteImage(galleryID int, filename string) error {
 		return fmt.Errorf("deleting image: %w", err)
 	}
 
-	err = os.Remove(image.Path)
+	tx, err := gs.DB.Begin()
 	if err != nil {
 		return fmt.Errorf("deleting image: %w", err)
 	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM images WHERE id=$1`, image.ID)
+	if err != nil {
+		return fmt.Errorf("deleting image: %w", err)
+	}
+	last, err := releaseBlob(tx, image.Key)
+	if err != nil {
+		return fmt.Errorf("deleting image: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("deleting image: %w", err)
+	}
+	if last {
+		gs.deleteReleased([]string{image.Key})
+	}
 	return nil
 }
 
-func (gs *GalleryService) imageContentTypes() []string {
-	return []string{"image/png", "image/jpg", "image/jpeg", "image/gif"}
+// Open returns the contents of image. The caller must close the reader.
+func (gs *GalleryService) Open(image Image) (io.ReadCloser, storage.ObjectInfo, error) {
+	rc, info, err := gs.storage().Get(image.Key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotExist) {
+			return nil, storage.ObjectInfo{}, ErrNotFound
+		}
+		return nil, storage.ObjectInfo{}, fmt.Errorf("open image: %w", err)
+	}
+	if info.ContentType == "" {
+		info.ContentType = image.ContentType
+	}
+	return rc, info, nil
 }
-func (gs *GalleryService) extensions() []string {
-	return []string{".png", ".jpg", ".jpeg", ".gif"}
+
+// ReconcileResult reports the changes made by GalleryService.Reconcile.
+type ReconcileResult struct {
+	Added   []string
+	Removed []string
 }
 
-func (gs *GalleryService) galleryDir(id int) string {
-	imagesDir := gs.ImagesDir
-	if imagesDir == "" {
-		imagesDir = "images"
+// Reconcile backfills image rows for files in the gallery storage that are not
+// yet recorded in the database. When prune is set, rows whose file no longer
+// exists in storage are removed as well.
+func (gs *GalleryService) Reconcile(galleryID int, prune bool) (*ReconcileResult, error) {
+	var result ReconcileResult
+
+	images, err := gs.Images(galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("reconcile gallery %d: %w", galleryID, err)
+	}
+	known := make(map[string]bool, len(images))
+	for _, image := range images {
+		known[image.Filename] = true
+	}
+
+	prefix := gs.galleryPrefix(galleryID)
+	objects, err := gs.storage().List(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("reconcile gallery %d: %w", galleryID, err)
+	}
+	onDisk := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		filename := strings.TrimPrefix(obj.Key, prefix)
+		if strings.Contains(filename, "/") || !hasExtension(filename, gs.extensions()) {
+			continue
+		}
+		onDisk[filename] = true
+		if known[filename] {
+			continue
+		}
+		err := gs.backfillImage(galleryID, filename)
+		if err != nil {
+			return nil, fmt.Errorf("reconcile gallery %d: %w", galleryID, err)
+		}
+		result.Added = append(result.Added, filename)
 	}
-	return filepath.Join(imagesDir, fmt.Sprintf("gallery-%d", id))
+
+	if prune {
+		for _, image := range images {
+			exists, err := gs.stored(image, onDisk)
+			if err != nil {
+				return nil, fmt.Errorf("reconcile gallery %d: %w", galleryID, err)
+			}
+			if exists {
+				continue
+			}
+			err = gs.DeleteImage(galleryID, image.Filename)
+			if err != nil {
+				return nil, fmt.Errorf("reconcile gallery %d: %w", galleryID, err)
+			}
+			result.Removed = append(result.Removed, image.Filename)
+		}
+	}
+
+	return &result, nil
+}
+
+// stored reports whether the file of image exists. onDisk holds the files
+// found under the gallery prefix; blobs live elsewhere and are checked one by
+// one.
+func (gs *GalleryService) stored(image Image, onDisk map[string]bool) (bool, error) {
+	if !isBlobKey(image.Key) {
+		return onDisk[image.Filename], nil
+	}
+	_, err := gs.storage().Stat(image.Key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (gs *GalleryService) backfillImage(galleryID int, filename string) error {
+	image := Image{
+		GalleryID: galleryID,
+		Key:       gs.imageKey(galleryID, filename),
+		Filename:  filename,
+	}
+
+	rc, _, err := gs.storage().Get(image.Key)
+	if err != nil {
+		return fmt.Errorf("backfill image %v: %w", filename, err)
+	}
+	defer rc.Close()
+	// Buffer the contents since sniffing needs to rewind the reader.
+	contents, err := io.ReadAll(rc)
+	if err != nil {
+		return fmt.Errorf("backfill image %v: %w", filename, err)
+	}
+	r := bytes.NewReader(contents)
+
+	format, err := checkFormat(r, gs.AllowedFormats())
+	if err != nil {
+		return fmt.Errorf("backfill image %v: %w", filename, err)
+	}
+	image.ContentType = format.ContentType
+	// Dimensions are best effort for files that predate validation.
+	image.Width, image.Height, _ = gs.imageDimensions(r, format)
+	// A failed decode leaves the reader mid-file, so rewind before hashing.
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("backfill image %v: %w", filename, err)
+	}
+	image.SHA256, image.Size, err = hashContents(r)
+	if err != nil {
+		return fmt.Errorf("backfill image %v: %w", filename, err)
+	}
+
+	image.DisplayName = filename
+
+	tx, err := gs.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("backfill image %v: %w", filename, err)
+	}
+	defer tx.Rollback()
+	// The file stays under its gallery key; Deduplicate can move it later.
+	_, err = insertImage(tx, &image, false)
+	if err != nil {
+		return fmt.Errorf("backfill image %v: %w", filename, err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("backfill image %v: %w", filename, err)
+	}
+	logRenditionError(gs.createRenditions(image, r))
+	return nil
+}
+
+// insertImage records image, appending it to the end of the gallery. If the
+// filename is taken, replace points the existing row at the new contents;
+// otherwise insertImage reports false.
+func insertImage(tx *sql.Tx, image *Image, replace bool) (bool, error) {
+	onConflict := `DO NOTHING`
+	if replace {
+		onConflict = `DO UPDATE
+	SET display_name=$3, content_type=$4, byte_size=$5, width=$6, height=$7, sha256=$8, storage_key=$9, uploaded_at=now()`
+	}
+	row := tx.QueryRow(`
+	INSERT INTO images (gallery_id, filename, display_name, content_type, byte_size, width, height, sha256, storage_key, position)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9,
+		(SELECT COALESCE(MAX(position) + 1, 0) FROM images WHERE gallery_id=$1))
+	ON CONFLICT (gallery_id, filename) `+onConflict+`
+	RETURNING id, uploaded_at, position;
+	`, image.GalleryID, image.Filename, image.DisplayName, image.ContentType, image.Size, image.Width, image.Height,
+		image.SHA256, image.Key)
+	err := row.Scan(&image.ID, &image.UploadedAt, &image.Position)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("insert image: %w", err)
+	}
+	return true, nil
+}
+
+// hashContents returns the hex encoded SHA-256 and size of r and rewinds it.
+func hashContents(r io.ReadSeeker) (string, int64, error) {
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, r)
+	if err != nil {
+		return "", 0, fmt.Errorf("hash contents: %w", err)
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", 0, fmt.Errorf("hash contents: %w", err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+func (gs *GalleryService) storage() storage.Store {
+	if gs.Storage == nil {
+		return storage.Local{}
+	}
+	return gs.Storage
+}
+
+func (gs *GalleryService) galleryPrefix(id int) string {
+	return fmt.Sprintf("gallery-%d/", id)
+}
+
+func (gs *GalleryService) imageKey(galleryID int, filename string) string {
+	return path.Join(gs.galleryPrefix(galleryID), filename)
 }
 
 func hasExtension(file string, extensions []string) bool {
@@ -0,0 +1,271 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	JobPending = "pending"
+	JobDone    = "done"
+	// JobDead marks jobs that exhausted their attempts. They are kept for
+	// inspection until retried.
+	JobDead = "dead"
+
+	DefaultJobMaxAttempts  = 5
+	DefaultJobPollInterval = time.Second
+	DefaultJobRetention    = 7 * 24 * time.Hour
+
+	jobBaseBackoff = 30 * time.Second
+	jobMaxBackoff  = time.Hour
+	// jobLease is how long a claimed job is left to its worker before
+	// another may run it again, in case the first one died.
+	jobLease = 15 * time.Minute
+)
+
+type Job struct {
+	ID          int64
+	Kind        string
+	Payload     json.RawMessage
+	Status      string
+	Attempts    int
+	MaxAttempts int
+	RunAt       time.Time
+	LastError   string
+}
+
+type JobService struct {
+	DB          *sql.DB
+	MaxAttempts int
+	// Retention is how long finished jobs are kept. Defaults to DefaultJobRetention.
+	Retention time.Duration
+}
+
+// Enqueue schedules a job of the given kind. payload is stored as JSON and
+// handed to the handler registered for kind.
+func (js *JobService) Enqueue(kind string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("enqueue %v: %w", kind, err)
+	}
+	maxAttempts := js.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultJobMaxAttempts
+	}
+
+	_, err = js.DB.Exec(`INSERT INTO jobs (kind, payload, max_attempts) VALUES ($1, $2, $3)`, kind, string(b), maxAttempts)
+	if err != nil {
+		return fmt.Errorf("enqueue %v: %w", kind, err)
+	}
+	return nil
+}
+
+// Retry moves a dead job back to the queue with a fresh set of attempts.
+func (js *JobService) Retry(id int64) error {
+	result, err := js.DB.Exec(`
+	UPDATE jobs SET status=$2, attempts=0, run_at=now(), updated_at=now()
+	WHERE id=$1 AND status=$3`, id, JobPending, JobDead)
+	if err != nil {
+		return fmt.Errorf("retry job: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("retry job: %w", err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteFinished removes completed jobs older than the retention period.
+func (js *JobService) DeleteFinished() (int64, error) {
+	retention := js.Retention
+	if retention <= 0 {
+		retention = DefaultJobRetention
+	}
+	result, err := js.DB.Exec(`DELETE FROM jobs WHERE status=$1 AND updated_at < $2`, JobDone, time.Now().Add(-retention))
+	if err != nil {
+		return 0, fmt.Errorf("delete finished jobs: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// JobHandler processes the JSON payload of a job. Returning an error schedules
+// a retry with exponential backoff.
+type JobHandler func(payload json.RawMessage) error
+
+// JobWorker claims jobs with SELECT ... FOR UPDATE SKIP LOCKED so any number
+// of workers, across any number of servers, can share one queue. Claiming a
+// job counts the attempt and leases the job before the handler runs, so a
+// handler that takes the whole process down still uses up its attempts and
+// the job ends up dead instead of crashing every worker in turn.
+type JobWorker struct {
+	DB           *sql.DB
+	PollInterval time.Duration
+	Concurrency  int
+
+	// unexported fields
+	handlers map[string]JobHandler
+}
+
+func (jw *JobWorker) Handle(kind string, handler JobHandler) {
+	if jw.handlers == nil {
+		jw.handlers = make(map[string]JobHandler)
+	}
+	jw.handlers[kind] = handler
+}
+
+// Run processes jobs until ctx is done.
+func (jw *JobWorker) Run(ctx context.Context) {
+	concurrency := jw.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			jw.loop(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (jw *JobWorker) loop(ctx context.Context) {
+	interval := jw.PollInterval
+	if interval <= 0 {
+		interval = DefaultJobPollInterval
+	}
+	for {
+		worked, err := jw.work(ctx)
+		if err != nil {
+			log.Printf("jobs: %v", err)
+		}
+		if worked {
+			// Keep draining the queue without waiting.
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// work claims and runs a single job. It reports whether a job was found.
+func (jw *JobWorker) work(ctx context.Context) (bool, error) {
+	job, ok, err := jw.claim(ctx)
+	if err != nil || !ok || job.Status == JobDead {
+		return ok, err
+	}
+
+	// The result is recorded even if ctx ends meanwhile, so a finished job
+	// is not run again once its lease runs out.
+	err = jw.run(job)
+	if err == nil {
+		_, err = jw.DB.Exec(`
+		UPDATE jobs SET status=$2, last_error='', updated_at=now()
+		WHERE id=$1 AND attempts=$3`, job.ID, JobDone, job.Attempts)
+	} else {
+		log.Printf("jobs: %v #%d attempt %d: %v", job.Kind, job.ID, job.Attempts, err)
+		status := JobPending
+		if job.Attempts >= job.MaxAttempts {
+			status = JobDead
+		}
+		// Matching attempts leaves the job alone if the lease ran out and
+		// another worker claimed it meanwhile.
+		_, err = jw.DB.Exec(`
+		UPDATE jobs SET status=$2, run_at=$4, last_error=$5, updated_at=now()
+		WHERE id=$1 AND attempts=$3`, job.ID, status, job.Attempts, time.Now().Add(jobBackoff(job.Attempts)), err.Error())
+	}
+	if err != nil {
+		return true, fmt.Errorf("finish job %d: %w", job.ID, err)
+	}
+	return true, nil
+}
+
+// claim takes the next due job, counting the attempt and leasing the job in
+// its own transaction. A job whose attempts ran out without a result, because
+// its worker died, is returned marked dead instead and must not be run. It
+// reports whether a job was found.
+func (jw *JobWorker) claim(ctx context.Context) (Job, bool, error) {
+	kinds := make([]string, 0, len(jw.handlers))
+	for kind := range jw.handlers {
+		kinds = append(kinds, kind)
+	}
+
+	tx, err := jw.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return Job{}, false, fmt.Errorf("claim job: %w", err)
+	}
+	defer tx.Rollback()
+
+	var job Job
+	var payload []byte
+	row := tx.QueryRow(`
+	SELECT id, kind, payload, attempts, max_attempts
+	FROM jobs
+	WHERE status=$1 AND run_at <= now() AND kind = ANY($2)
+	ORDER BY run_at, id
+	LIMIT 1
+	FOR UPDATE SKIP LOCKED`, JobPending, kinds)
+	err = row.Scan(&job.ID, &job.Kind, &payload, &job.Attempts, &job.MaxAttempts)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Job{}, false, nil
+		}
+		return Job{}, false, fmt.Errorf("claim job: %w", err)
+	}
+	job.Payload = payload
+	job.Status = JobPending
+
+	if job.Attempts >= job.MaxAttempts {
+		job.Status = JobDead
+		log.Printf("jobs: %v #%d: worker stopped during the last attempt", job.Kind, job.ID)
+		_, err = tx.Exec(`
+		UPDATE jobs SET status=$2, last_error=$3, updated_at=now()
+		WHERE id=$1`, job.ID, JobDead, "worker stopped during the last attempt")
+	} else {
+		job.Attempts++
+		_, err = tx.Exec(`
+		UPDATE jobs SET attempts=$2, run_at=$3, updated_at=now()
+		WHERE id=$1`, job.ID, job.Attempts, time.Now().Add(jobLease))
+	}
+	if err != nil {
+		return Job{}, true, fmt.Errorf("claim job %d: %w", job.ID, err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return Job{}, true, fmt.Errorf("claim job %d: %w", job.ID, err)
+	}
+	return job, true, nil
+}
+
+// run calls the job handler, turning a panic into an error so the job is
+// retried rather than taking the worker down.
+func (jw *JobWorker) run(job Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return jw.handlers[job.Kind](job.Payload)
+}
+
+// jobBackoff doubles the delay with every attempt, up to jobMaxBackoff.
+func jobBackoff(attempts int) time.Duration {
+	backoff := jobBaseBackoff
+	for i := 1; i < attempts && backoff < jobMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, jobMaxBackoff)
+}
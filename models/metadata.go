@@ -0,0 +1,317 @@
+package models
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"example/web-go/imaging"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// cleanJPEG reads the EXIF of a JPEG upload and rewrites it so it displays
+// upright everywhere and, unless the gallery keeps GPS, carries no location.
+// The location is dropped from the returned EXIF as well in that case.
+func (gs *GalleryService) cleanJPEG(galleryID int, contents io.ReadSeeker) (io.ReadSeeker, *imaging.EXIF, error) {
+	src, err := io.ReadAll(contents)
+	if err != nil {
+		return nil, nil, fmt.Errorf("clean jpeg: %w", err)
+	}
+	// Metadata is a nicety; a photo with broken EXIF is still a photo.
+	exif, err := imaging.ReadEXIF(src)
+	if err != nil {
+		exif = nil
+	}
+
+	keepGPS, err := gs.keepGPS(galleryID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("clean jpeg: %w", err)
+	}
+	cleaned, err := imaging.CleanJPEG(src, !keepGPS)
+	if err != nil {
+		return nil, nil, FileError{
+			Issue: fmt.Sprintf("unreadable image: %v", err),
+		}
+	}
+	if exif != nil && !keepGPS {
+		exif.GPS = nil
+	}
+	return bytes.NewReader(cleaned), exif, nil
+}
+
+// stripLocation removes the location from an upload in a format other than
+// JPEG unless the gallery keeps GPS. Images whose location cannot be removed
+// are refused rather than published with it.
+func (gs *GalleryService) stripLocation(galleryID int, contents io.ReadSeeker, format imaging.Format) (io.ReadSeeker, error) {
+	keepGPS, err := gs.keepGPS(galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("strip location: %w", err)
+	}
+	if keepGPS {
+		return contents, nil
+	}
+	src, err := io.ReadAll(contents)
+	if err != nil {
+		return nil, fmt.Errorf("strip location: %w", err)
+	}
+	stripped, err := imaging.StripGPS(src, format)
+	if err != nil {
+		if errors.Is(err, imaging.ErrCannotStripGPS) {
+			return nil, FileError{
+				Issue: fmt.Sprintf("the location cannot be removed from %v images; upload it as a JPEG or without location data", strings.ToUpper(format.Name)),
+			}
+		}
+		return nil, FileError{
+			Issue: fmt.Sprintf("unreadable image: %v", err),
+		}
+	}
+	return bytes.NewReader(stripped), nil
+}
+
+func (gs *GalleryService) keepGPS(galleryID int) (bool, error) {
+	var keep bool
+	row := gs.DB.QueryRow(`SELECT keep_gps FROM galleries WHERE id=$1`, galleryID)
+	err := row.Scan(&keep)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, ErrNotFound
+		}
+		return false, fmt.Errorf("keep gps: %w", err)
+	}
+	return keep, nil
+}
+
+// saveMetadata records the EXIF of image, replacing what a previous image of
+// the same row had.
+func saveMetadata(tx *sql.Tx, image *Image) error {
+	if image.EXIF == nil {
+		_, err := tx.Exec(`DELETE FROM image_metadata WHERE image_id=$1`, image.ID)
+		if err != nil {
+			return fmt.Errorf("save metadata: %w", err)
+		}
+		return nil
+	}
+
+	x := image.EXIF
+	var takenAt sql.NullTime
+	if !x.TakenAt.IsZero() {
+		takenAt = sql.NullTime{Time: x.TakenAt, Valid: true}
+	}
+	var lat, lon sql.NullFloat64
+	if x.GPS != nil {
+		lat = sql.NullFloat64{Float64: x.GPS.Latitude, Valid: true}
+		lon = sql.NullFloat64{Float64: x.GPS.Longitude, Valid: true}
+	}
+	_, err := tx.Exec(`
+	INSERT INTO image_metadata (image_id, camera_make, camera_model, lens, exposure_time,
+		f_number, iso, focal_length, taken_at, latitude, longitude)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	ON CONFLICT (image_id) DO UPDATE
+	SET camera_make=$2, camera_model=$3, lens=$4, exposure_time=$5,
+		f_number=$6, iso=$7, focal_length=$8, taken_at=$9, latitude=$10, longitude=$11`,
+		image.ID, x.Make, x.Model, x.LensModel, x.ExposureTime,
+		x.FNumber, x.ISO, x.FocalLength, takenAt, lat, lon)
+	if err != nil {
+		return fmt.Errorf("save metadata: %w", err)
+	}
+	return nil
+}
+
+// ImageMetadata returns the EXIF of the images in a gallery, keyed by image
+// ID. Images without metadata are left out. Orientation is not stored since
+// images are rotated upright on upload.
+func (gs *GalleryService) ImageMetadata(galleryID int) (map[int]*imaging.EXIF, error) {
+	rows, err := gs.DB.Query(`
+	SELECT m.image_id, m.camera_make, m.camera_model, m.lens, m.exposure_time,
+		m.f_number, m.iso, m.focal_length, m.taken_at, m.latitude, m.longitude
+	FROM image_metadata m
+	JOIN images i ON i.id = m.image_id
+	WHERE i.gallery_id=$1`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("image metadata: %w", err)
+	}
+	defer rows.Close()
+
+	metadata := make(map[int]*imaging.EXIF)
+	for rows.Next() {
+		var id int
+		var takenAt sql.NullTime
+		var lat, lon sql.NullFloat64
+		x := imaging.EXIF{Orientation: 1}
+		err := rows.Scan(&id, &x.Make, &x.Model, &x.LensModel, &x.ExposureTime,
+			&x.FNumber, &x.ISO, &x.FocalLength, &takenAt, &lat, &lon)
+		if err != nil {
+			return nil, fmt.Errorf("image metadata: %w", err)
+		}
+		if takenAt.Valid {
+			x.TakenAt = takenAt.Time
+		}
+		if lat.Valid && lon.Valid {
+			x.GPS = &imaging.GPS{Latitude: lat.Float64, Longitude: lon.Float64}
+		}
+		metadata[id] = &x
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("image metadata: %w", err)
+	}
+	return metadata, nil
+}
+
+// StripGPS removes the location from the photos a gallery already holds
+// unless it keeps GPS, for photos uploaded before locations were stripped or
+// while the gallery still kept them. It returns how many images it rewrote.
+// Images whose location cannot be removed are logged and left alone.
+func (gs *GalleryService) StripGPS(galleryID int) (int, error) {
+	keepGPS, err := gs.keepGPS(galleryID)
+	if err != nil {
+		return 0, fmt.Errorf("strip gps in gallery %d: %w", galleryID, err)
+	}
+	if keepGPS {
+		return 0, nil
+	}
+
+	_, err = gs.DB.Exec(`
+	UPDATE image_metadata SET latitude=NULL, longitude=NULL
+	WHERE image_id IN (SELECT id FROM images WHERE gallery_id=$1)`, galleryID)
+	if err != nil {
+		return 0, fmt.Errorf("strip gps in gallery %d: %w", galleryID, err)
+	}
+
+	images, err := gs.Images(galleryID)
+	if err != nil {
+		return 0, fmt.Errorf("strip gps in gallery %d: %w", galleryID, err)
+	}
+	var stripped int
+	for _, image := range images {
+		ok, err := gs.stripImageGPS(image)
+		if err != nil {
+			return stripped, fmt.Errorf("strip gps in gallery %d: %w", galleryID, err)
+		}
+		if ok {
+			stripped++
+		}
+	}
+	return stripped, nil
+}
+
+// stripImageGPS rewrites image without its location, storing the result as
+// a new blob since the contents change. It reports false if there was
+// nothing to strip or the image was replaced meanwhile.
+func (gs *GalleryService) stripImageGPS(image Image) (bool, error) {
+	rc, _, err := gs.storage().Get(image.Key)
+	if err != nil {
+		return false, fmt.Errorf("strip gps from %v: %w", image.Filename, err)
+	}
+	src, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return false, fmt.Errorf("strip gps from %v: %w", image.Filename, err)
+	}
+	format, ok := imaging.FormatByContentType(image.ContentType)
+	if !ok {
+		return false, nil
+	}
+	// Cleaning may decode the image, so make sure that is safe first.
+	_, _, err = gs.imageDimensions(bytes.NewReader(src), format)
+	if err != nil {
+		var fileErr FileError
+		if errors.As(err, &fileErr) {
+			log.Printf("strip gps from %v in gallery %d: %v", image.Filename, image.GalleryID, err)
+			return false, nil
+		}
+		return false, fmt.Errorf("strip gps from %v: %w", image.Filename, err)
+	}
+	var cleaned []byte
+	if format.Name == imaging.JPEG.Name {
+		cleaned, err = imaging.CleanJPEG(src, true)
+	} else {
+		cleaned, err = imaging.StripGPS(src, format)
+	}
+	if err != nil {
+		if errors.Is(err, imaging.ErrCannotStripGPS) {
+			log.Printf("strip gps from %v in gallery %d: %v", image.Filename, image.GalleryID, err)
+			return false, nil
+		}
+		return false, fmt.Errorf("strip gps from %v: %w", image.Filename, err)
+	}
+	if bytes.Equal(cleaned, src) {
+		return false, nil
+	}
+
+	if format.Name == imaging.JPEG.Name {
+		image.EXIF, err = imaging.ReadEXIF(src)
+		if err != nil {
+			image.EXIF = nil
+		} else {
+			image.EXIF.GPS = nil
+		}
+	}
+	r := bytes.NewReader(cleaned)
+	// Cleaning also turns photos upright, which may swap their dimensions.
+	image.Width, image.Height, err = gs.imageDimensions(r, format)
+	if err != nil {
+		return false, fmt.Errorf("strip gps from %v: %w", image.Filename, err)
+	}
+	image.SHA256, image.Size, err = hashContents(r)
+	if err != nil {
+		return false, fmt.Errorf("strip gps from %v: %w", image.Filename, err)
+	}
+
+	tx, err := gs.DB.Begin()
+	if err != nil {
+		return false, fmt.Errorf("strip gps from %v: %w", image.Filename, err)
+	}
+	defer tx.Rollback()
+
+	old := image.Key
+	current, err := storageKey(tx, image.GalleryID, image.Filename)
+	if err != nil {
+		return false, fmt.Errorf("strip gps from %v: %w", image.Filename, err)
+	}
+	if current != old {
+		return false, nil
+	}
+	var created bool
+	image.Key, created, err = acquireBlob(tx, image.SHA256, image.Size)
+	if err != nil {
+		return false, fmt.Errorf("strip gps from %v: %w", image.Filename, err)
+	}
+	if created {
+		err = gs.storage().Put(image.Key, r, image.ContentType)
+		if err != nil {
+			return false, fmt.Errorf("strip gps from %v: %w", image.Filename, err)
+		}
+	}
+	_, err = tx.Exec(`
+	UPDATE images SET storage_key=$2, sha256=$3, byte_size=$4, width=$5, height=$6
+	WHERE id=$1`, image.ID, image.Key, image.SHA256, image.Size, image.Width, image.Height)
+	if err != nil {
+		return false, fmt.Errorf("strip gps from %v: %w", image.Filename, err)
+	}
+	err = saveMetadata(tx, &image)
+	if err != nil {
+		return false, fmt.Errorf("strip gps from %v: %w", image.Filename, err)
+	}
+	last, err := releaseBlob(tx, old)
+	if err != nil {
+		return false, fmt.Errorf("strip gps from %v: %w", image.Filename, err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return false, fmt.Errorf("strip gps from %v: %w", image.Filename, err)
+	}
+
+	if last {
+		gs.deleteReleased([]string{old})
+	}
+	if created {
+		_, err = r.Seek(0, io.SeekStart)
+		if err != nil {
+			return true, fmt.Errorf("strip gps from %v: %w", image.Filename, err)
+		}
+		logRenditionError(gs.createRenditions(image, r))
+	}
+	return true, nil
+}
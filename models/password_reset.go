@@ -2,6 +2,7 @@ package models
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -31,6 +32,9 @@ func (s *PasswordResetService) Create(email string) (*PasswordReset, error) {
 	row := s.DB.QueryRow(`SELECT id FROM users WHERE email=$1`, email)
 	err := row.Scan(&userID)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("create: %w", ErrNotFound)
+		}
 		return nil, fmt.Errorf("create: %w", err)
 	}
 	newToken, err := newToken(s.BytesPerToken)
@@ -64,19 +68,22 @@ func (s *PasswordResetService) Consume(token string) (*User, error) {
 	var pwReset PasswordReset
 	row := s.DB.QueryRow(`
 	SELECT password_resets.id, password_resets.expires_at, 
-	users.id, users.email, users.password_hash
+	users.id, users.email, users.password_hash, users.totp_enabled_at IS NOT NULL
 	FROM password_resets 
 	JOIN users ON users.id = password_resets.user_id
 	WHERE password_resets.token_hash = $1
 	`, tokenHash)
 
-	err := row.Scan(&pwReset.ID, &pwReset.ExpiresAt, &user.ID, &user.Email, &user.PasswordHash)
+	err := row.Scan(&pwReset.ID, &pwReset.ExpiresAt, &user.ID, &user.Email, &user.PasswordHash, &user.TOTPEnabled)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("comsume: %w", ErrTokenInvalid)
+		}
 		return nil, fmt.Errorf("comsume: %w", err)
 	}
 
 	if time.Now().After(pwReset.ExpiresAt) {
-		return nil, fmt.Errorf("token expired: %v", err)
+		return nil, fmt.Errorf("comsume: %w", ErrTokenExpired)
 	}
 
 	err = s.delete(pwReset.ID)
@@ -87,6 +94,15 @@ func (s *PasswordResetService) Consume(token string) (*User, error) {
 	return &user, nil
 }
 
+// DeleteExpired removes password resets that can no longer be consumed.
+func (s *PasswordResetService) DeleteExpired() (int64, error) {
+	result, err := s.DB.Exec(`DELETE FROM password_resets WHERE expires_at <= now();`)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired: %w", err)
+	}
+	return result.RowsAffected()
+}
+
 func (s *PasswordResetService) delete(id int) error {
 	_, err := s.DB.Exec(`DELETE FROM password_resets WHERE id=$1;`, id)
 	if err != nil {
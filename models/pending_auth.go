@@ -0,0 +1,102 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultPendingAuthDuration = 5 * time.Minute
+	MaxPendingAuthAttempts     = 5
+)
+
+// PendingAuth is a sign in that passed the password check and is waiting for
+// a second factor. No session exists until it is completed.
+type PendingAuth struct {
+	ID     int
+	UserID int
+	// Token is only set when creating. Only store hash in db.
+	Token     string
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+type PendingAuthService struct {
+	DB            *sql.DB
+	BytesPerToken int
+	Duration      time.Duration
+}
+
+func (s *PendingAuthService) Create(userID int) (*PendingAuth, error) {
+	newToken, err := newToken(s.BytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create pending auth: %w", err)
+	}
+	duration := s.Duration
+	if duration == 0 {
+		duration = DefaultPendingAuthDuration
+	}
+	pending := PendingAuth{
+		UserID:    userID,
+		Token:     newToken.Token,
+		TokenHash: newToken.TokenHash,
+		ExpiresAt: time.Now().Add(duration),
+	}
+	row := s.DB.QueryRow(`
+	INSERT INTO pending_auths (user_id, token_hash, expires_at)
+	VALUES ($1, $2, $3) RETURNING id`, pending.UserID, pending.TokenHash, pending.ExpiresAt)
+	err = row.Scan(&pending.ID)
+	if err != nil {
+		return nil, fmt.Errorf("create pending auth: %w", err)
+	}
+	return &pending, nil
+}
+
+// User returns the user waiting on token. Expired tokens and tokens with too
+// many failed attempts are reported as ErrNotFound.
+func (s *PendingAuthService) User(token string) (*User, error) {
+	var user User
+	row := s.DB.QueryRow(`
+	SELECT u.id, u.email, u.password_hash
+	FROM pending_auths p
+	JOIN users u ON u.id = p.user_id
+	WHERE p.token_hash=$1 AND p.expires_at > now() AND p.attempts < $2`, hash(token), MaxPendingAuthAttempts)
+	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("pending auth user: %w", err)
+	}
+	user.TOTPEnabled = true
+	return &user, nil
+}
+
+// Fail records a wrong code. Once MaxPendingAuthAttempts is reached the user
+// has to start over with their password.
+func (s *PendingAuthService) Fail(token string) error {
+	_, err := s.DB.Exec(`UPDATE pending_auths SET attempts=attempts+1 WHERE token_hash=$1`, hash(token))
+	if err != nil {
+		return fmt.Errorf("fail pending auth: %w", err)
+	}
+	return nil
+}
+
+func (s *PendingAuthService) Delete(token string) error {
+	_, err := s.DB.Exec(`DELETE FROM pending_auths WHERE token_hash=$1`, hash(token))
+	if err != nil {
+		return fmt.Errorf("delete pending auth: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpired removes sign ins that were never completed.
+func (s *PendingAuthService) DeleteExpired() (int64, error) {
+	result, err := s.DB.Exec(`DELETE FROM pending_auths WHERE expires_at <= now() OR attempts >= $1;`, MaxPendingAuthAttempts)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired: %w", err)
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,244 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"example/web-go/imaging"
+	"example/web-go/storage"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"path"
+)
+
+const (
+	SizeThumb    = "thumb"
+	SizeMedium   = "medium"
+	SizeOriginal = "original"
+
+	JobImageRenditions = "image.renditions"
+)
+
+// renditionWidths holds the maximum width of each derived size, smallest
+// first.
+var renditionWidths = []struct {
+	size  string
+	width int
+}{
+	{SizeThumb, 400},
+	{SizeMedium, 1200},
+}
+
+// Rendition describes one size an image can be served at.
+type Rendition struct {
+	Size   string
+	Width  int
+	Height int
+}
+
+// Renditions lists every size of the image from smallest to largest, ending
+// with the original. Derived sizes are never larger than the original, and
+// formats that cannot be decoded only have the original.
+func (img Image) Renditions() []Rendition {
+	var renditions []Rendition
+	for _, rw := range renditionWidths {
+		if !img.format().Decode || img.Width <= rw.width {
+			break
+		}
+		width, height := imaging.FitSize(img.Width, img.Height, rw.width)
+		renditions = append(renditions, Rendition{Size: rw.size, Width: width, Height: height})
+	}
+	return append(renditions, Rendition{Size: SizeOriginal, Width: img.Width, Height: img.Height})
+}
+
+// ValidSize reports whether size names a rendition.
+func ValidSize(size string) bool {
+	if size == SizeOriginal {
+		return true
+	}
+	for _, rw := range renditionWidths {
+		if rw.size == size {
+			return true
+		}
+	}
+	return false
+}
+
+// GenerateRenditions reads the original image from storage and writes every
+// derived size.
+func (gs *GalleryService) GenerateRenditions(image Image) error {
+	rc, _, err := gs.storage().Get(image.Key)
+	if err != nil {
+		return fmt.Errorf("generate renditions: %w", err)
+	}
+	defer rc.Close()
+
+	return gs.createRenditions(image, rc)
+}
+
+type renditionsJob struct {
+	GalleryID int    `json:"gallery_id"`
+	Filename  string `json:"filename"`
+}
+
+// HandleRenditionsJob is the JobHandler for JobImageRenditions.
+func (gs *GalleryService) HandleRenditionsJob(payload json.RawMessage) error {
+	var job renditionsJob
+	err := json.Unmarshal(payload, &job)
+	if err != nil {
+		return fmt.Errorf("decode renditions job: %w", err)
+	}
+	image, err := gs.Image(job.GalleryID, job.Filename)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			// The image was deleted before the job ran.
+			return nil
+		}
+		return fmt.Errorf("renditions job: %w", err)
+	}
+	return gs.GenerateRenditions(image)
+}
+
+// HasFallback reports whether the image is in a format some browsers cannot
+// display, and is also kept at full size in imaging.FallbackFormat for them.
+func (img Image) HasFallback() bool {
+	f := img.format()
+	return f.Decode && !f.Encode
+}
+
+func (img Image) format() imaging.Format {
+	f, ok := imaging.FormatByContentType(img.ContentType)
+	if !ok {
+		// Images predating the format registry were all decodable.
+		return imaging.Format{ContentType: img.ContentType, Decode: true, Encode: true}
+	}
+	return f
+}
+
+// OpenRendition returns the contents of the image at the given size. accepts
+// reports whether the client can display a content type; the original is
+// swapped for its fallback when the client cannot display it. Missing
+// renditions, for example while they are still being generated, fall back to
+// the original.
+func (gs *GalleryService) OpenRendition(image Image, size string, accepts func(contentType string) bool) (io.ReadCloser, storage.ObjectInfo, error) {
+	if size == "" {
+		size = SizeOriginal
+	}
+	if size == SizeOriginal && (!image.HasFallback() || accepts(image.ContentType)) {
+		return gs.Open(image)
+	}
+	rc, info, err := gs.storage().Get(renditionKey(image, size))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotExist) {
+			return gs.Open(image)
+		}
+		return nil, storage.ObjectInfo{}, fmt.Errorf("open rendition: %w", err)
+	}
+	if info.ContentType == "" {
+		info.ContentType = imaging.RenditionFormat(image.format()).ContentType
+	}
+	return rc, info, nil
+}
+
+func (gs *GalleryService) createRenditions(img Image, r io.Reader) error {
+	if !img.format().Decode {
+		// Served as uploaded at every size.
+		return nil
+	}
+	// Images stored before sizes were checked may be too large to decode,
+	// so read the header first and replay it to the decoder.
+	var header bytes.Buffer
+	config, _, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return fmt.Errorf("create renditions for %v: %w", img.Filename, err)
+	}
+	err = gs.checkPixels(config.Width, config.Height)
+	if err != nil {
+		return fmt.Errorf("create renditions for %v: %w", img.Filename, err)
+	}
+	src, _, err := image.Decode(io.MultiReader(&header, r))
+	if err != nil {
+		return fmt.Errorf("create renditions for %v: %w", img.Filename, err)
+	}
+	format := imaging.RenditionFormat(img.format())
+
+	if img.HasFallback() {
+		err := gs.putRendition(img, SizeOriginal, src, format)
+		if err != nil {
+			return fmt.Errorf("create renditions for %v: %w", img.Filename, err)
+		}
+	}
+
+	// Scale from the largest size down so each pass reads fewer pixels.
+	scaled := src
+	for i := len(renditionWidths) - 1; i >= 0; i-- {
+		rw := renditionWidths[i]
+		if src.Bounds().Dx() <= rw.width {
+			continue
+		}
+		scaled = imaging.Fit(scaled, rw.width)
+
+		err := gs.putRendition(img, rw.size, scaled, format)
+		if err != nil {
+			return fmt.Errorf("create renditions for %v: %w", img.Filename, err)
+		}
+	}
+	return nil
+}
+
+func (gs *GalleryService) putRendition(img Image, size string, src image.Image, format imaging.Format) error {
+	var buf bytes.Buffer
+	err := imaging.Encode(&buf, src, format.ContentType)
+	if err != nil {
+		return fmt.Errorf("encode %v rendition: %w", size, err)
+	}
+	err = gs.storage().Put(renditionKey(img, size), bytes.NewReader(buf.Bytes()), format.ContentType)
+	if err != nil {
+		return fmt.Errorf("store %v rendition: %w", size, err)
+	}
+	return nil
+}
+
+// deleteRenditions removes the derived sizes of the original stored under key,
+// in whichever format they were made.
+func (gs *GalleryService) deleteRenditions(key string) error {
+	var keys []string
+	for _, rw := range renditionWidths {
+		k := sizeKey(key, rw.size)
+		keys = append(keys, k, k+imaging.FallbackFormat.Extension())
+	}
+	keys = append(keys, sizeKey(key, SizeOriginal)+imaging.FallbackFormat.Extension())
+	for _, k := range keys {
+		err := gs.storage().Delete(k)
+		if err != nil {
+			return fmt.Errorf("delete renditions for %v: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// renditionKey places derived sizes in a directory next to the original, so
+// "gallery-1/a.jpg" has its thumbnail at "gallery-1/thumb/a.jpg". Renditions
+// in another format than the original carry that format's extension, as in
+// "gallery-1/thumb/a.webp.jpg", so storage serves them with the right type.
+func renditionKey(img Image, size string) string {
+	key := sizeKey(img.Key, size)
+	if img.HasFallback() {
+		key += imaging.RenditionFormat(img.format()).Extension()
+	}
+	return key
+}
+
+func sizeKey(key, size string) string {
+	return path.Join(path.Dir(key), size, path.Base(key))
+}
+
+// logRenditionError reports a failed rendition without failing the upload;
+// the original is served until the renditions exist.
+func logRenditionError(err error) {
+	if err != nil {
+		log.Printf("renditions: %v", err)
+	}
+}
@@ -4,28 +4,50 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"errors"
 	"example/web-go/rand"
 	"fmt"
+	"time"
 )
 
 const (
 	MinBytesPerToken = 32
+
+	DefaultSessionDuration    = 30 * 24 * time.Hour
+	DefaultSessionIdleTimeout = 7 * 24 * time.Hour
 )
 
 type Session struct {
 	ID     int
 	UserID int
 	// Token is only set when creating a new session. Only store hash in db.
-	Token     string
-	TokenHash string
+	Token      string
+	TokenHash  string
+	UserAgent  string
+	IPAddress  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	// ExpiresAt is the absolute lifetime of the session, IdleExpiresAt is
+	// pushed forward on activity but never past ExpiresAt.
+	ExpiresAt     time.Time
+	IdleExpiresAt time.Time
+}
+
+// Matches reports whether token belongs to this session.
+func (s Session) Matches(token string) bool {
+	return s.TokenHash == hash(token)
 }
 
 type SessionService struct {
 	DB            *sql.DB
 	BytesPerToken int
+	// Duration is the absolute session lifetime. Defaults to DefaultSessionDuration.
+	Duration time.Duration
+	// IdleTimeout ends sessions without activity. Defaults to DefaultSessionIdleTimeout.
+	IdleTimeout time.Duration
 }
 
-func (ss SessionService) Create(userID int) (*Session, error) {
+func (ss SessionService) Create(userID int, userAgent, ipAddress string) (*Session, error) {
 
 	newToken, err := newToken(ss.BytesPerToken)
 
@@ -37,14 +59,18 @@ func (ss SessionService) Create(userID int) (*Session, error) {
 		UserID:    userID,
 		Token:     newToken.Token,
 		TokenHash: newToken.TokenHash,
+		UserAgent: userAgent,
+		IPAddress: ipAddress,
 	}
-
-	row := ss.DB.QueryRow(`UPDATE sessions SET token_hash=$2 WHERE user_id=$1 RETURNING id`, session.UserID, session.TokenHash)
-	err = row.Scan(&session.ID)
-	if err == sql.ErrNoRows {
-		row = ss.DB.QueryRow(`INSERT INTO sessions (user_id, token_hash) VALUES ($1, $2) RETURNING id`, session.UserID, session.TokenHash)
-		err = row.Scan(&session.ID)
-	}
+	now := time.Now()
+	session.ExpiresAt = now.Add(ss.duration())
+	session.IdleExpiresAt = earliest(now.Add(ss.idleTimeout()), session.ExpiresAt)
+
+	row := ss.DB.QueryRow(`
+	INSERT INTO sessions (user_id, token_hash, user_agent, ip_address, expires_at, idle_expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at, last_seen_at
+	`, session.UserID, session.TokenHash, session.UserAgent, session.IPAddress, session.ExpiresAt, session.IdleExpiresAt)
+	err = row.Scan(&session.ID, &session.CreatedAt, &session.LastSeenAt)
 	if err != nil {
 		return nil, fmt.Errorf("create session: %w", err)
 	}
@@ -53,21 +79,32 @@ func (ss SessionService) Create(userID int) (*Session, error) {
 
 func (ss SessionService) User(token string) (*User, error) {
 	var user User
+	var expiresAt, idleExpiresAt time.Time
+	var verifiedAt sql.NullTime
 
 	query := `
-		SELECT u.id, u.email, u.password_hash
+		SELECT u.id, u.email, u.password_hash, u.email_verified_at, s.expires_at, s.idle_expires_at
 		FROM sessions s
 		JOIN users u ON s.user_id = u.id
 		WHERE s.token_hash = $1
 	`
 
 	row := ss.DB.QueryRow(query, hash(token))
-	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash)
+	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash, &verifiedAt, &expiresAt, &idleExpiresAt)
 
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("retrieving user with token: %w", ErrTokenInvalid)
+		}
 		return nil, fmt.Errorf("retrieving user with token: %w", err)
 	}
 
+	now := time.Now()
+	if now.After(expiresAt) || now.After(idleExpiresAt) {
+		return nil, fmt.Errorf("retrieving user with token: %w", ErrTokenExpired)
+	}
+	user.EmailVerifiedAt = verifiedAt.Time
+
 	return &user, nil
 }
 
@@ -82,6 +119,115 @@ func (ss SessionService) Delete(token string) error {
 	return nil
 }
 
+// Touch records activity on the session identified by token and slides its
+// idle expiry forward. The updated session is returned so callers can refresh
+// the cookie.
+func (ss SessionService) Touch(token string) (*Session, error) {
+	session := Session{
+		TokenHash: hash(token),
+	}
+	idleExpiresAt := time.Now().Add(ss.idleTimeout())
+
+	row := ss.DB.QueryRow(`
+	UPDATE sessions
+	SET last_seen_at=now(), idle_expires_at=LEAST($2, expires_at)
+	WHERE token_hash=$1 AND expires_at > now() AND idle_expires_at > now()
+	RETURNING id, user_id, last_seen_at, expires_at, idle_expires_at
+	`, session.TokenHash, idleExpiresAt)
+	err := row.Scan(&session.ID, &session.UserID, &session.LastSeenAt, &session.ExpiresAt, &session.IdleExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("touch session: %w", err)
+	}
+	return &session, nil
+}
+
+// ByUserID returns every active session of the user, most recently used first.
+func (ss SessionService) ByUserID(userID int) ([]Session, error) {
+	rows, err := ss.DB.Query(`
+	SELECT id, token_hash, user_agent, ip_address, created_at, last_seen_at
+	FROM sessions
+	WHERE user_id=$1
+	AND expires_at > now() AND idle_expires_at > now()
+	ORDER BY last_seen_at DESC
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query sessions by user: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		session := Session{
+			UserID: userID,
+		}
+		err := rows.Scan(&session.ID, &session.TokenHash, &session.UserAgent, &session.IPAddress, &session.CreatedAt, &session.LastSeenAt)
+		if err != nil {
+			return nil, fmt.Errorf("query sessions by user: %w", err)
+		}
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query sessions by user: %w", err)
+	}
+	return sessions, nil
+}
+
+// DeleteByID revokes a single session. The session must belong to userID.
+func (ss SessionService) DeleteByID(userID, id int) error {
+	var deletedID int
+	row := ss.DB.QueryRow(`DELETE FROM sessions WHERE id=$1 AND user_id=$2 RETURNING id`, id, userID)
+	err := row.Scan(&deletedID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("delete session: %w", err)
+	}
+	return nil
+}
+
+// DeleteOthers revokes every session of the user except the one identified by token.
+func (ss SessionService) DeleteOthers(userID int, token string) error {
+	_, err := ss.DB.Exec(`DELETE FROM sessions WHERE user_id=$1 AND token_hash<>$2`, userID, hash(token))
+	if err != nil {
+		return fmt.Errorf("delete other sessions: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpired removes sessions past their absolute or idle expiry.
+func (ss SessionService) DeleteExpired() (int64, error) {
+	result, err := ss.DB.Exec(`DELETE FROM sessions WHERE expires_at <= now() OR idle_expires_at <= now()`)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired sessions: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+func (ss SessionService) duration() time.Duration {
+	if ss.Duration <= 0 {
+		return DefaultSessionDuration
+	}
+	return ss.Duration
+}
+
+func (ss SessionService) idleTimeout() time.Duration {
+	if ss.IdleTimeout <= 0 {
+		return DefaultSessionIdleTimeout
+	}
+	return ss.IdleTimeout
+}
+
+func earliest(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
 func hash(token string) string {
 	tokenHash := sha256.Sum256([]byte(token))
 	return base64.URLEncoding.EncodeToString(tokenHash[:])
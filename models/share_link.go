@@ -0,0 +1,173 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type ShareLink struct {
+	ID        int
+	GalleryID int
+	// Token is only set when creating a new link. Only store hash in db.
+	Token        string
+	TokenHash    string
+	PasswordHash string
+	// ExpiresAt is zero for links that never expire.
+	ExpiresAt time.Time
+	ViewCount int
+	CreatedAt time.Time
+}
+
+func (sl ShareLink) HasPassword() bool {
+	return sl.PasswordHash != ""
+}
+
+func (sl ShareLink) Expired() bool {
+	return !sl.ExpiresAt.IsZero() && time.Now().After(sl.ExpiresAt)
+}
+
+type ShareLinkService struct {
+	DB            *sql.DB
+	BytesPerToken int
+}
+
+// Create mints a link to the gallery. An empty password leaves the link
+// unprotected and a zero expiresAt makes it valid until revoked.
+func (s *ShareLinkService) Create(galleryID int, password string, expiresAt time.Time) (*ShareLink, error) {
+	newToken, err := newToken(s.BytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create share link: %w", err)
+	}
+	link := ShareLink{
+		GalleryID: galleryID,
+		Token:     newToken.Token,
+		TokenHash: newToken.TokenHash,
+		ExpiresAt: expiresAt,
+	}
+	if password != "" {
+		hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, fmt.Errorf("create share link: %w", err)
+		}
+		link.PasswordHash = string(hashedBytes)
+	}
+
+	var expires sql.NullTime
+	if !expiresAt.IsZero() {
+		expires = sql.NullTime{Time: expiresAt, Valid: true}
+	}
+	row := s.DB.QueryRow(`
+	INSERT INTO share_links (gallery_id, token_hash, password_hash, expires_at)
+	VALUES ($1, $2, $3, $4) RETURNING id, created_at`,
+		link.GalleryID, link.TokenHash, link.PasswordHash, expires)
+	err = row.Scan(&link.ID, &link.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("create share link: %w", err)
+	}
+	return &link, nil
+}
+
+// ByToken returns the link for token. Expired links are reported as
+// ErrNotFound.
+func (s *ShareLinkService) ByToken(token string) (*ShareLink, error) {
+	link := ShareLink{
+		TokenHash: hash(token),
+	}
+	var expires sql.NullTime
+	row := s.DB.QueryRow(`
+	SELECT id, gallery_id, password_hash, expires_at, view_count, created_at
+	FROM share_links WHERE token_hash=$1`, link.TokenHash)
+	err := row.Scan(&link.ID, &link.GalleryID, &link.PasswordHash, &expires, &link.ViewCount, &link.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("share link by token: %w", err)
+	}
+	link.ExpiresAt = expires.Time
+	if link.Expired() {
+		return nil, ErrNotFound
+	}
+	return &link, nil
+}
+
+func (s *ShareLinkService) ByGalleryID(galleryID int) ([]ShareLink, error) {
+	rows, err := s.DB.Query(`
+	SELECT id, password_hash, expires_at, view_count, created_at
+	FROM share_links WHERE gallery_id=$1
+	ORDER BY created_at DESC`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("share links by gallery: %w", err)
+	}
+	defer rows.Close()
+
+	var links []ShareLink
+	for rows.Next() {
+		link := ShareLink{
+			GalleryID: galleryID,
+		}
+		var expires sql.NullTime
+		err := rows.Scan(&link.ID, &link.PasswordHash, &expires, &link.ViewCount, &link.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("share links by gallery: %w", err)
+		}
+		link.ExpiresAt = expires.Time
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("share links by gallery: %w", err)
+	}
+	return links, nil
+}
+
+// RecordView increments the view counter of the link.
+func (s *ShareLinkService) RecordView(id int) error {
+	_, err := s.DB.Exec(`UPDATE share_links SET view_count = view_count + 1 WHERE id=$1`, id)
+	if err != nil {
+		return fmt.Errorf("record share link view: %w", err)
+	}
+	return nil
+}
+
+// CheckPassword reports whether password unlocks the link.
+func (s *ShareLinkService) CheckPassword(link *ShareLink, password string) bool {
+	if !link.HasPassword() {
+		return true
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(password))
+	return err == nil
+}
+
+// UnlockKey returns the value a visitor presents to prove they entered the
+// link password. It changes whenever the password does and cannot be derived
+// from the token alone.
+func (s *ShareLinkService) UnlockKey(link *ShareLink) string {
+	return hash(link.TokenHash + ":" + link.PasswordHash)
+}
+
+// Delete revokes a link. The link must belong to galleryID.
+func (s *ShareLinkService) Delete(galleryID, id int) error {
+	var deletedID int
+	row := s.DB.QueryRow(`DELETE FROM share_links WHERE id=$1 AND gallery_id=$2 RETURNING id`, id, galleryID)
+	err := row.Scan(&deletedID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("delete share link: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpired removes links past their expiry.
+func (s *ShareLinkService) DeleteExpired() (int64, error) {
+	result, err := s.DB.Exec(`DELETE FROM share_links WHERE expires_at <= now()`)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired share links: %w", err)
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const (
+	DefaultSweepInterval = 10 * time.Minute
+)
+
+// SweepFunc deletes dead rows and reports how many were removed.
+type SweepFunc func() (int64, error)
+
+// Sweeper periodically runs cleanup tasks in the background.
+type Sweeper struct {
+	Interval time.Duration
+
+	// unexported fields
+	tasks []sweepTask
+}
+
+type sweepTask struct {
+	name string
+	fn   SweepFunc
+}
+
+func (s *Sweeper) Add(name string, fn SweepFunc) {
+	s.tasks = append(s.tasks, sweepTask{name: name, fn: fn})
+}
+
+// Run sweeps once immediately and then on every interval until ctx is done.
+func (s *Sweeper) Run(ctx context.Context) {
+	interval := s.Interval
+	if interval <= 0 {
+		interval = DefaultSweepInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.sweep()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Sweeper) sweep() {
+	for _, task := range s.tasks {
+		n, err := task.fn()
+		if err != nil {
+			log.Printf("sweep %s: %v", task.name, err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("sweep %s: removed %d rows", task.name, n)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"example/web-go/rand"
+	"example/web-go/totp"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultTOTPIssuer = "WebGo"
+	RecoveryCodeCount = 10
+	// recoveryCodeBytes gives 10 base32 characters per code.
+	recoveryCodeBytes = 6
+)
+
+// TwoFactorStatus describes a user's TOTP enrollment.
+type TwoFactorStatus struct {
+	Enabled bool
+	// PendingSecret is set between Begin and Confirm.
+	PendingSecret     string
+	RecoveryCodesLeft int
+}
+
+type TwoFactorService struct {
+	DB *sql.DB
+	// Issuer names the site in authenticator apps. Defaults to DefaultTOTPIssuer.
+	Issuer string
+}
+
+func (s *TwoFactorService) Status(userID int) (*TwoFactorStatus, error) {
+	var status TwoFactorStatus
+	var secret string
+	row := s.DB.QueryRow(`
+	SELECT totp_secret, totp_enabled_at IS NOT NULL,
+	(SELECT count(*) FROM recovery_codes WHERE user_id=users.id AND used_at IS NULL)
+	FROM users WHERE id=$1`, userID)
+	err := row.Scan(&secret, &status.Enabled, &status.RecoveryCodesLeft)
+	if err != nil {
+		return nil, fmt.Errorf("two factor status: %w", err)
+	}
+	if !status.Enabled {
+		status.PendingSecret = secret
+	}
+	return &status, nil
+}
+
+// Begin starts enrollment by storing a new secret. TOTP is not enforced until
+// the user proves they can generate codes with Confirm.
+func (s *TwoFactorService) Begin(userID int) (string, error) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", fmt.Errorf("begin two factor: %w", err)
+	}
+	result, err := s.DB.Exec(`
+	UPDATE users SET totp_secret=$2, totp_last_step=0
+	WHERE id=$1 AND totp_enabled_at IS NULL`, userID, secret)
+	if err != nil {
+		return "", fmt.Errorf("begin two factor: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return "", fmt.Errorf("begin two factor: %w", err)
+	}
+	if n == 0 {
+		return "", fmt.Errorf("begin two factor: already enabled")
+	}
+	return secret, nil
+}
+
+// Confirm enables TOTP if code matches the pending secret and returns a fresh
+// set of recovery codes. The codes are only stored hashed.
+func (s *TwoFactorService) Confirm(userID int, code string) ([]string, error) {
+	var secret string
+	row := s.DB.QueryRow(`
+	SELECT totp_secret FROM users
+	WHERE id=$1 AND totp_enabled_at IS NULL AND totp_secret <> ''`, userID)
+	err := row.Scan(&secret)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("confirm two factor: %w", err)
+	}
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("confirm two factor: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE users SET totp_enabled_at=now(), totp_last_step=$2 WHERE id=$1`, userID, step)
+	if err != nil {
+		return nil, fmt.Errorf("confirm two factor: %w", err)
+	}
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("confirm two factor: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("confirm two factor: %w", err)
+	}
+	return codes, nil
+}
+
+// Verify checks a TOTP code or an unused recovery code for userID. Each TOTP
+// code and each recovery code is accepted once.
+func (s *TwoFactorService) Verify(userID int, code string) error {
+	var secret string
+	row := s.DB.QueryRow(`
+	SELECT totp_secret FROM users
+	WHERE id=$1 AND totp_enabled_at IS NOT NULL`, userID)
+	err := row.Scan(&secret)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("verify two factor: %w", err)
+	}
+
+	if step, ok := totp.Validate(secret, code, time.Now()); ok {
+		// The step only moves forward, so a replayed code updates no rows.
+		result, err := s.DB.Exec(`
+		UPDATE users SET totp_last_step=$2
+		WHERE id=$1 AND totp_last_step < $2`, userID, step)
+		if err != nil {
+			return fmt.Errorf("verify two factor: %w", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("verify two factor: %w", err)
+		}
+		if n == 0 {
+			return ErrInvalidCode
+		}
+		return nil
+	}
+
+	var id int
+	row = s.DB.QueryRow(`
+	UPDATE recovery_codes SET used_at=now()
+	WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL
+	RETURNING id`, userID, hash(normalizeRecoveryCode(code)))
+	err = row.Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidCode
+		}
+		return fmt.Errorf("verify two factor: %w", err)
+	}
+	return nil
+}
+
+// RegenerateRecoveryCodes invalidates all existing recovery codes and returns
+// new ones.
+func (s *TwoFactorService) RegenerateRecoveryCodes(userID int) ([]string, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("regenerate recovery codes: %w", err)
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("regenerate recovery codes: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("regenerate recovery codes: %w", err)
+	}
+	return codes, nil
+}
+
+func (s *TwoFactorService) Disable(userID int) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("disable two factor: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	UPDATE users SET totp_secret='', totp_enabled_at=NULL, totp_last_step=0
+	WHERE id=$1`, userID)
+	if err != nil {
+		return fmt.Errorf("disable two factor: %w", err)
+	}
+	_, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_id=$1`, userID)
+	if err != nil {
+		return fmt.Errorf("disable two factor: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("disable two factor: %w", err)
+	}
+	return nil
+}
+
+// URI returns the provisioning URI to add secret to an authenticator app.
+func (s *TwoFactorService) URI(email, secret string) string {
+	issuer := s.Issuer
+	if issuer == "" {
+		issuer = DefaultTOTPIssuer
+	}
+	return totp.URI(issuer, email, secret)
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID int) ([]string, error) {
+	_, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id=$1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, RecoveryCodeCount)
+	for i := 0; i < RecoveryCodeCount; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`,
+			userID, hash(normalizeRecoveryCode(code)))
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// newRecoveryCode returns a code formatted as xxxxx-xxxxx.
+func newRecoveryCode() (string, error) {
+	b, err := rand.Bytes(recoveryCodeBytes)
+	if err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+	code = code[:10]
+	return code[:5] + "-" + code[5:], nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
@@ -0,0 +1,389 @@
+package models
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"example/web-go/storage"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultUploadDuration = 24 * time.Hour
+	DefaultMaxUploadSize  = 100 << 20
+
+	uploadsPrefix = "uploads/"
+	// uploadFinishTimeout is how long an upload stays claimed by the request
+	// finishing it, in case that request died without releasing it.
+	uploadFinishTimeout = 10 * time.Minute
+)
+
+// UploadSession is an image being uploaded in chunks. Chunks are kept in the
+// gallery storage until the last one arrives, so an upload survives dropped
+// connections and server restarts.
+type UploadSession struct {
+	ID        int
+	GalleryID int
+	Filename  string
+	// Size is the length of the whole file, declared up front.
+	Size int64
+	// Offset is how many bytes have been received so far.
+	Offset int64
+	// Finishing is set on the upload returned by the Append that completed
+	// it, which is the only caller that may pass it to Finish.
+	Finishing bool
+	ExpiresAt time.Time
+}
+
+// Complete reports whether every byte of the file has been received.
+func (u *UploadSession) Complete() bool {
+	return u.Offset == u.Size
+}
+
+// UploadOffsetError is returned when a chunk does not start where the
+// previous one ended, usually because the client lost track after a dropped
+// connection. Offset tells it where to resume.
+type UploadOffsetError struct {
+	Offset int64
+}
+
+func (e UploadOffsetError) Error() string {
+	return fmt.Sprintf("upload offset mismatch: expected %d", e.Offset)
+}
+
+type UploadSessionService struct {
+	DB *sql.DB
+	// Galleries stores the chunks and receives the assembled image.
+	Galleries *GalleryService
+	// Duration an upload may sit idle before it is discarded. Defaults to
+	// DefaultUploadDuration.
+	Duration time.Duration
+	// MaxSize is the largest file that can be uploaded. Defaults to
+	// DefaultMaxUploadSize.
+	MaxSize int64
+	// StagingDir is where chunks are assembled before the image is created.
+	// Defaults to the system temporary directory.
+	StagingDir string
+}
+
+// Create starts an upload of size bytes. The extension is checked now so a
+// client does not send a large file only to have it rejected at the end; the
+// contents are checked by CreateImage once they have all arrived.
+func (s *UploadSessionService) Create(galleryID int, filename string, size int64) (*UploadSession, error) {
+	// Keep the name as uploaded; CreateImage sanitizes it at the end.
+	filename = DisplayName(filename)
+	sanitized := SanitizeFilename(filename)
+	if sanitized == "" {
+		return nil, FileError{Issue: "invalid file name"}
+	}
+	err := checkExtension(sanitized, s.Galleries.extensions())
+	if err != nil {
+		return nil, fmt.Errorf("create upload: %w", err)
+	}
+	if size <= 0 {
+		return nil, FileError{Issue: "file is empty"}
+	}
+	if size > s.maxSize() {
+		return nil, FileError{Issue: fmt.Sprintf("larger than %d bytes", s.maxSize())}
+	}
+
+	upload := UploadSession{
+		GalleryID: galleryID,
+		Filename:  filename,
+		Size:      size,
+	}
+	row := s.DB.QueryRow(`
+	INSERT INTO upload_sessions (gallery_id, filename, byte_size, expires_at)
+	VALUES ($1, $2, $3, $4) RETURNING id, expires_at`,
+		galleryID, filename, size, time.Now().Add(s.duration()))
+	err = row.Scan(&upload.ID, &upload.ExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("create upload: %w", err)
+	}
+	return &upload, nil
+}
+
+// ByID returns an upload to galleryID. Expired uploads are reported as
+// ErrNotFound.
+func (s *UploadSessionService) ByID(galleryID, id int) (*UploadSession, error) {
+	upload := UploadSession{
+		ID:        id,
+		GalleryID: galleryID,
+	}
+	row := s.DB.QueryRow(`
+	SELECT filename, byte_size, byte_offset, expires_at
+	FROM upload_sessions
+	WHERE id=$1 AND gallery_id=$2 AND expires_at > now()`, id, galleryID)
+	err := row.Scan(&upload.Filename, &upload.Size, &upload.Offset, &upload.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("upload by id: %w", err)
+	}
+	return &upload, nil
+}
+
+// Append stores chunk as the bytes starting at offset, which must be the
+// current offset of the upload. The upload row stays locked while the chunk
+// is written so concurrent requests cannot interleave. The call that leaves
+// the upload complete claims it for finishing; later calls get ErrFinishing
+// until Finish is done with it.
+func (s *UploadSessionService) Append(galleryID, id int, offset int64, chunk []byte) (*UploadSession, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("append upload: %w", err)
+	}
+	defer tx.Rollback()
+
+	upload := UploadSession{
+		ID:        id,
+		GalleryID: galleryID,
+	}
+	var finishing bool
+	row := tx.QueryRow(`
+	SELECT filename, byte_size, byte_offset, COALESCE(finishing_at > $3, false)
+	FROM upload_sessions
+	WHERE id=$1 AND gallery_id=$2 AND expires_at > now()
+	FOR UPDATE`, id, galleryID, time.Now().Add(-uploadFinishTimeout))
+	err = row.Scan(&upload.Filename, &upload.Size, &upload.Offset, &finishing)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("append upload: %w", err)
+	}
+	if finishing {
+		return nil, ErrFinishing
+	}
+	if offset != upload.Offset {
+		return nil, UploadOffsetError{Offset: upload.Offset}
+	}
+	if offset+int64(len(chunk)) > upload.Size {
+		return nil, FileError{Issue: fmt.Sprintf("upload is longer than the declared %d bytes", upload.Size)}
+	}
+	upload.Finishing = offset+int64(len(chunk)) == upload.Size
+	if len(chunk) == 0 && !upload.Finishing {
+		return &upload, nil
+	}
+
+	if len(chunk) > 0 {
+		err = s.Galleries.storage().Put(s.chunkKey(id, offset), bytes.NewReader(chunk), "application/octet-stream")
+		if err != nil {
+			return nil, fmt.Errorf("append upload: %w", err)
+		}
+	}
+	var finishingAt sql.NullTime
+	if upload.Finishing {
+		finishingAt = sql.NullTime{Time: time.Now(), Valid: true}
+	}
+	row = tx.QueryRow(`
+	UPDATE upload_sessions SET byte_offset=$2, expires_at=$3, finishing_at=$4
+	WHERE id=$1 RETURNING byte_offset, expires_at`,
+		id, offset+int64(len(chunk)), time.Now().Add(s.duration()), finishingAt)
+	err = row.Scan(&upload.Offset, &upload.ExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("append upload: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("append upload: %w", err)
+	}
+	return &upload, nil
+}
+
+// Finish assembles a complete upload in the staging directory and hands it
+// to CreateImage. upload must have been claimed by Append. The upload is
+// discarded afterwards unless assembling failed for a reason worth retrying,
+// in which case the claim is released so the client can finish it again.
+func (s *UploadSessionService) Finish(upload *UploadSession) (Image, error) {
+	if !upload.Complete() {
+		return Image{}, fmt.Errorf("finish upload: %d of %d bytes received", upload.Offset, upload.Size)
+	}
+	if !upload.Finishing {
+		return Image{}, fmt.Errorf("finish upload: %w", ErrFinishing)
+	}
+	image, err := s.finish(upload)
+	if err != nil {
+		var fileErr FileError
+		if errors.As(err, &fileErr) || errors.Is(err, ErrImageExists) {
+			// The upload will not get any better on a retry.
+			s.discard(upload.ID)
+		} else {
+			s.release(upload.ID)
+		}
+		return Image{}, fmt.Errorf("finish upload: %w", err)
+	}
+	s.discard(upload.ID)
+	return image, nil
+}
+
+func (s *UploadSessionService) finish(upload *UploadSession) (Image, error) {
+	f, err := os.CreateTemp(s.StagingDir, "upload-*")
+	if err != nil {
+		return Image{}, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = s.assemble(f, upload)
+	if err != nil {
+		return Image{}, err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return Image{}, err
+	}
+	return s.Galleries.CreateImage(upload.GalleryID, upload.Filename, f)
+}
+
+// assemble copies the chunks of upload to w in order.
+func (s *UploadSessionService) assemble(w io.Writer, upload *UploadSession) error {
+	chunks, err := s.Galleries.storage().List(s.chunkPrefix(upload.ID))
+	if err != nil {
+		return fmt.Errorf("assemble: %w", err)
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Key < chunks[j].Key })
+
+	var written int64
+	for _, chunk := range chunks {
+		if chunk.Key != s.chunkKey(upload.ID, written) {
+			return fmt.Errorf("assemble: missing chunk at offset %d", written)
+		}
+		rc, _, err := s.Galleries.storage().Get(chunk.Key)
+		if err != nil {
+			return fmt.Errorf("assemble: %w", err)
+		}
+		n, err := io.Copy(w, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("assemble: %w", err)
+		}
+		written += n
+	}
+	if written != upload.Size {
+		return fmt.Errorf("assemble: got %d of %d bytes", written, upload.Size)
+	}
+	return nil
+}
+
+// Delete abandons an upload and its chunks.
+func (s *UploadSessionService) Delete(galleryID, id int) error {
+	result, err := s.DB.Exec(`DELETE FROM upload_sessions WHERE id=$1 AND gallery_id=$2`, id, galleryID)
+	if err != nil {
+		return fmt.Errorf("delete upload: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("delete upload: %w", err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	err = storage.DeletePrefix(s.Galleries.storage(), s.chunkPrefix(id))
+	if err != nil {
+		return fmt.Errorf("delete upload: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpired removes uploads that went idle, along with chunks left by
+// uploads whose gallery was deleted.
+func (s *UploadSessionService) DeleteExpired() (int64, error) {
+	// List the chunks before reading the live uploads, so an upload started
+	// in between cannot lose its first chunk.
+	chunks, err := s.Galleries.storage().List(uploadsPrefix)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired: %w", err)
+	}
+
+	result, err := s.DB.Exec(`DELETE FROM upload_sessions WHERE expires_at <= now()`)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete expired: %w", err)
+	}
+
+	rows, err := s.DB.Query(`SELECT id FROM upload_sessions`)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired: %w", err)
+	}
+	defer rows.Close()
+	live := make(map[string]bool)
+	for rows.Next() {
+		var id int
+		err := rows.Scan(&id)
+		if err != nil {
+			return 0, fmt.Errorf("delete expired: %w", err)
+		}
+		live[strconv.Itoa(id)] = true
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("delete expired: %w", err)
+	}
+
+	for _, chunk := range chunks {
+		id, _, _ := strings.Cut(strings.TrimPrefix(chunk.Key, uploadsPrefix), "/")
+		if live[id] {
+			continue
+		}
+		err := s.Galleries.storage().Delete(chunk.Key)
+		if err != nil {
+			return deleted, fmt.Errorf("delete expired: %w", err)
+		}
+	}
+	return deleted, nil
+}
+
+// discard removes a finished upload. Failing to do so only leaves work for
+// DeleteExpired, so it is not worth failing the request over.
+func (s *UploadSessionService) discard(id int) {
+	_, err := s.DB.Exec(`DELETE FROM upload_sessions WHERE id=$1`, id)
+	if err == nil {
+		err = storage.DeletePrefix(s.Galleries.storage(), s.chunkPrefix(id))
+	}
+	if err != nil {
+		log.Printf("discard upload %d: %v", id, err)
+	}
+}
+
+// release lets a failed upload be finished again by the client's next
+// request. Failing to do so only makes it wait for uploadFinishTimeout.
+func (s *UploadSessionService) release(id int) {
+	_, err := s.DB.Exec(`UPDATE upload_sessions SET finishing_at=NULL WHERE id=$1`, id)
+	if err != nil {
+		log.Printf("release upload %d: %v", id, err)
+	}
+}
+
+func (s *UploadSessionService) chunkPrefix(id int) string {
+	return fmt.Sprintf("%s%d/", uploadsPrefix, id)
+}
+
+// chunkKey zero pads the offset so keys sort in upload order.
+func (s *UploadSessionService) chunkKey(id int, offset int64) string {
+	return fmt.Sprintf("%s%020d", s.chunkPrefix(id), offset)
+}
+
+func (s *UploadSessionService) duration() time.Duration {
+	if s.Duration == 0 {
+		return DefaultUploadDuration
+	}
+	return s.Duration
+}
+
+func (s *UploadSessionService) maxSize() int64 {
+	if s.MaxSize == 0 {
+		return DefaultMaxUploadSize
+	}
+	return s.MaxSize
+}
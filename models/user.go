@@ -3,34 +3,76 @@ package models
 import (
 	"database/sql"
 	"errors"
+	"example/web-go/password"
 	"fmt"
+	"log"
 	"strings"
+	"time"
 
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5/pgconn"
-	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	DefaultMaxFailedLogins = 5
+	DefaultLockoutDuration = time.Minute
+	MaxLockoutDuration     = 24 * time.Hour
+)
+
+// LockedError is returned by Authenticate for emails locked after too many
+// failed sign ins, whether or not an account uses the email.
+type LockedError struct {
+	Until time.Time
+}
+
+func (e LockedError) Error() string {
+	return fmt.Sprintf("account locked until %s", e.Until.Format(time.RFC3339))
+}
+
 type User struct {
 	ID           int
 	Email        string
 	PasswordHash string
+	// EmailVerifiedAt is zero until the user follows the verification link.
+	EmailVerifiedAt time.Time
+	// TOTPEnabled requires a second factor at sign in.
+	TOTPEnabled bool
+	CreatedAt   time.Time
+	// DeleteAfter is set while the account is scheduled for deletion.
+	DeleteAfter time.Time
+}
+
+func (u User) Verified() bool {
+	return !u.EmailVerifiedAt.IsZero()
 }
 
 type UserService struct {
 	DB *sql.DB
+	// PasswordPolicy is applied to new passwords.
+	PasswordPolicy password.Policy
+	// Hasher hashes new passwords and decides which stored hashes are
+	// upgraded on sign in. Defaults to bcrypt at its default cost.
+	Hasher password.Hasher
+	// MaxFailedLogins is how many wrong passwords lock the account.
+	// Defaults to DefaultMaxFailedLogins.
+	MaxFailedLogins int
+	// LockoutDuration is the first lockout; each further failure doubles
+	// it, up to MaxLockoutDuration. Defaults to DefaultLockoutDuration.
+	LockoutDuration time.Duration
 }
 
 func (us *UserService) Create(email, password string) (*User, error) {
 	email = strings.ToLower(email)
 
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-
+	err := us.PasswordPolicy.Check(password, email)
 	if err != nil {
 		return nil, fmt.Errorf("create user: %w", err)
 	}
 
-	passwordHash := string(hashedBytes)
+	passwordHash, err := us.hasher().Hash(password)
+	if err != nil {
+		return nil, fmt.Errorf("create user: %w", err)
+	}
 
 	user := User{
 		Email:        email,
@@ -60,31 +102,261 @@ func (us *UserService) Authenticate(email, password string) (*User, error) {
 		Email: email,
 	}
 
-	row := us.DB.QueryRow(`SELECT id, password_hash FROM users WHERE email=$1`, email)
+	// Lockouts are tracked per email, whether or not an account has it, so
+	// a locked account looks the same as an unknown one. The password is not
+	// checked while locked, so guessing the right one reveals nothing.
+	err := us.checkLocked(email)
+	if err != nil {
+		return nil, fmt.Errorf("authenticate: %w", err)
+	}
+
+	var verifiedAt sql.NullTime
+	row := us.DB.QueryRow(`
+	SELECT id, password_hash, email_verified_at, totp_enabled_at IS NOT NULL
+	FROM users WHERE email=$1`, email)
 
-	err := row.Scan(&user.ID, &user.PasswordHash)
+	err = row.Scan(&user.ID, &user.PasswordHash, &verifiedAt, &user.TOTPEnabled)
 
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// Hash anyway so unknown emails take as long as wrong
+			// passwords.
+			us.hasher().Hash(password)
+			return nil, fmt.Errorf("authenticate: %w", us.recordFailedLogin(email))
+		}
 		return nil, fmt.Errorf("authenticate: %w", err)
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+	err = verifyPassword(user.PasswordHash, password)
 	if err != nil {
+		if errors.Is(err, ErrInvalidCredentials) {
+			return nil, fmt.Errorf("authenticate: %w", us.recordFailedLogin(email))
+		}
 		return nil, fmt.Errorf("authenticate: %w", err)
 	}
+	user.EmailVerifiedAt = verifiedAt.Time
+
+	err = us.clearFailedLogins(email)
+	if err != nil {
+		return nil, fmt.Errorf("authenticate: %w", err)
+	}
+
+	// This is the only time the plaintext is available, so hashes made
+	// with outdated parameters are upgraded now. A failed upgrade is retried
+	// on the next sign in.
+	if us.hasher().NeedsRehash(user.PasswordHash) {
+		err = us.rehash(&user, password)
+		if err != nil {
+			log.Printf("rehash password for user %d: %v", user.ID, err)
+		}
+	}
 
 	return &user, nil
 }
 
+func (us *UserService) ByID(id int) (*User, error) {
+	user := User{
+		ID: id,
+	}
+	var verifiedAt, deleteAfter sql.NullTime
+	row := us.DB.QueryRow(`
+	SELECT email, password_hash, email_verified_at, totp_enabled_at IS NOT NULL, created_at, delete_after
+	FROM users WHERE id=$1`, id)
+	err := row.Scan(&user.Email, &user.PasswordHash, &verifiedAt, &user.TOTPEnabled, &user.CreatedAt, &deleteAfter)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("user by id: %w", err)
+	}
+	user.EmailVerifiedAt = verifiedAt.Time
+	user.DeleteAfter = deleteAfter.Time
+	return &user, nil
+}
+
+// ChangePassword sets a new password after checking the current one with
+// CheckPassword.
+func (us *UserService) ChangePassword(userID int, current, newPassword string) error {
+	err := us.CheckPassword(userID, current)
+	if err != nil {
+		return fmt.Errorf("change password: %w", err)
+	}
+	err = us.UpdatePassword(userID, newPassword)
+	if err != nil {
+		return fmt.Errorf("change password: %w", err)
+	}
+	return nil
+}
+
+// CheckPassword re-authenticates a signed in user before a sensitive change.
+// A wrong password is reported as ErrInvalidCredentials and counts towards
+// the same lockout as Authenticate, which is reported as a LockedError.
+func (us *UserService) CheckPassword(userID int, plaintext string) error {
+	var email, passwordHash string
+	row := us.DB.QueryRow(`SELECT email, password_hash FROM users WHERE id=$1`, userID)
+	err := row.Scan(&email, &passwordHash)
+	if err != nil {
+		return fmt.Errorf("check password: %w", err)
+	}
+	err = us.checkLocked(email)
+	if err != nil {
+		return fmt.Errorf("check password: %w", err)
+	}
+	err = verifyPassword(passwordHash, plaintext)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCredentials) {
+			return fmt.Errorf("check password: %w", us.recordFailedLogin(email))
+		}
+		return fmt.Errorf("check password: %w", err)
+	}
+	err = us.clearFailedLogins(email)
+	if err != nil {
+		return fmt.Errorf("check password: %w", err)
+	}
+	return nil
+}
+
 func (us *UserService) UpdatePassword(userID int, password string) error {
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	var email string
+	row := us.DB.QueryRow(`SELECT email FROM users WHERE id=$1`, userID)
+	err := row.Scan(&email)
+	if err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
+	err = us.PasswordPolicy.Check(password, email)
+	if err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
+
+	passwordHash, err := us.hasher().Hash(password)
 	if err != nil {
 		return fmt.Errorf("update password: %w", err)
 	}
-	passwordHash := string(hashedBytes)
 	_, err = us.DB.Exec(`UPDATE users SET password_hash=$2 WHERE id=$1`, userID, passwordHash)
 	if err != nil {
 		return fmt.Errorf("update password: %w", err)
 	}
+	// Proving control of the account through a reset also lifts a lockout.
+	err = us.clearFailedLogins(email)
+	if err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
+	return nil
+}
+
+// checkLocked returns a LockedError while sign ins with email are locked.
+// The progressive lockout is kept in login_failures rather than on the user,
+// so it applies to addresses without an account too; see migration 00021.
+func (us *UserService) checkLocked(email string) error {
+	var lockedUntil sql.NullTime
+	row := us.DB.QueryRow(`SELECT locked_until FROM login_failures WHERE email=$1`, email)
+	err := row.Scan(&lockedUntil)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("check locked: %w", err)
+	}
+	if lockedUntil.Valid && time.Now().Before(lockedUntil.Time) {
+		return LockedError{Until: lockedUntil.Time}
+	}
+	return nil
+}
+
+// recordFailedLogin counts a failed sign in with email and locks it once
+// MaxFailedLogins is reached. The lockout doubles with every further
+// failure. It returns the error to report for the failure: a LockedError if
+// this failure locked the email, otherwise ErrInvalidCredentials.
+func (us *UserService) recordFailedLogin(email string) error {
+	var failed int
+	row := us.DB.QueryRow(`
+	INSERT INTO login_failures (email, failed_logins, updated_at)
+	VALUES ($1, 1, now())
+	ON CONFLICT (email) DO UPDATE
+	SET failed_logins = login_failures.failed_logins + 1, updated_at = now()
+	RETURNING failed_logins`, email)
+	err := row.Scan(&failed)
+	if err != nil {
+		return fmt.Errorf("record failed login: %w", err)
+	}
+
+	max := us.MaxFailedLogins
+	if max == 0 {
+		max = DefaultMaxFailedLogins
+	}
+	if failed < max {
+		return ErrInvalidCredentials
+	}
+
+	lockout := us.LockoutDuration
+	if lockout == 0 {
+		lockout = DefaultLockoutDuration
+	}
+	for i := max; i < failed && lockout < MaxLockoutDuration; i++ {
+		lockout *= 2
+	}
+	if lockout > MaxLockoutDuration {
+		lockout = MaxLockoutDuration
+	}
+
+	until := time.Now().Add(lockout)
+	_, err = us.DB.Exec(`UPDATE login_failures SET locked_until=$2 WHERE email=$1`, email, until)
+	if err != nil {
+		return fmt.Errorf("record failed login: %w", err)
+	}
+	return LockedError{Until: until}
+}
+
+func (us *UserService) clearFailedLogins(email string) error {
+	_, err := us.DB.Exec(`DELETE FROM login_failures WHERE email=$1`, email)
+	if err != nil {
+		return fmt.Errorf("clear failed logins: %w", err)
+	}
+	return nil
+}
+
+// DeleteStaleLoginFailures forgets failed sign ins that have not locked
+// anything and seen no new failures for MaxLockoutDuration.
+func (us *UserService) DeleteStaleLoginFailures() (int64, error) {
+	result, err := us.DB.Exec(`
+	DELETE FROM login_failures
+	WHERE (locked_until IS NULL OR locked_until <= now()) AND updated_at <= $1`,
+		time.Now().Add(-MaxLockoutDuration))
+	if err != nil {
+		return 0, fmt.Errorf("delete stale login failures: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+func (us *UserService) hasher() password.Hasher {
+	if us.Hasher == nil {
+		return password.Bcrypt{}
+	}
+	return us.Hasher
+}
+
+func (us *UserService) rehash(user *User, plaintext string) error {
+	passwordHash, err := us.hasher().Hash(plaintext)
+	if err != nil {
+		return err
+	}
+	// Only replace the hash that was verified, in case the password changed
+	// in the meantime.
+	_, err = us.DB.Exec(`UPDATE users SET password_hash=$3 WHERE id=$1 AND password_hash=$2`,
+		user.ID, user.PasswordHash, passwordHash)
+	if err != nil {
+		return err
+	}
+	user.PasswordHash = passwordHash
 	return nil
 }
+
+// verifyPassword returns ErrInvalidCredentials if plaintext does not match
+// passwordHash.
+func verifyPassword(passwordHash, plaintext string) error {
+	err := password.Verify(passwordHash, plaintext)
+	if errors.Is(err, password.ErrMismatch) {
+		return ErrInvalidCredentials
+	}
+	return err
+}
@@ -0,0 +1,192 @@
+package models
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// ZipLimits bounds what ImportZip extracts so a small upload cannot expand
+// into something that exhausts memory or disk. Zero fields use the defaults.
+type ZipLimits struct {
+	// MaxEntries is the most files an archive may contain.
+	MaxEntries int
+	// MaxFileSize is the largest uncompressed size of a single entry.
+	MaxFileSize int64
+	// MaxTotalSize is the largest uncompressed size of all entries.
+	MaxTotalSize int64
+	// MaxRatio is the highest uncompressed to compressed ratio allowed for
+	// an entry. Images barely compress, so a high ratio signals a zip bomb.
+	MaxRatio uint64
+}
+
+const (
+	DefaultZipMaxEntries   = 1000
+	DefaultZipMaxFileSize  = 50 << 20
+	DefaultZipMaxTotalSize = 2 << 30
+	DefaultZipMaxRatio     = 100
+)
+
+// ImportResult is the outcome of importing one entry of an archive.
+type ImportResult struct {
+	// Name is the entry name as it appears in the archive.
+	Name string
+	// Filename is the image the entry was saved as, if it was.
+	Filename string
+	Err      error
+}
+
+// ImportZip adds every image in the zip archive r to a gallery. Entries are
+// extracted one at a time and each one goes through the same checks as
+// CreateImage. Entries are saved under their base name, so paths in the
+// archive never reach storage, and name clashes follow the collision policy.
+//
+// A problem with a single entry is recorded in its ImportResult and the
+// import carries on. An error is returned only when the archive as a whole
+// cannot be read or exceeds the limits.
+func (gs *GalleryService) ImportZip(galleryID int, r io.ReaderAt, size int64) ([]ImportResult, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		if errors.Is(err, zip.ErrFormat) || errors.Is(err, zip.ErrAlgorithm) {
+			return nil, FileError{Issue: "not a valid zip archive"}
+		}
+		return nil, fmt.Errorf("import zip: %w", err)
+	}
+
+	limits := gs.zipLimits()
+	if len(zr.File) > limits.MaxEntries {
+		return nil, FileError{
+			Issue: fmt.Sprintf("archive has more than %d files", limits.MaxEntries),
+		}
+	}
+
+	var results []ImportResult
+	var total int64
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || zipJunk(f.Name) {
+			continue
+		}
+		result := ImportResult{Name: f.Name}
+
+		filename, err := zipEntryName(f.Name)
+		if err != nil {
+			result.Err = err
+			results = append(results, result)
+			continue
+		}
+		err = checkZipEntry(f, limits)
+		if err != nil {
+			result.Err = err
+			results = append(results, result)
+			continue
+		}
+
+		// The sizes in the header are only a claim, so the limits are
+		// enforced again on the bytes actually read.
+		contents, err := readZipEntry(f, limits.MaxFileSize)
+		if err != nil {
+			result.Err = err
+			results = append(results, result)
+			continue
+		}
+		total += int64(len(contents))
+		if total > limits.MaxTotalSize {
+			return results, FileError{
+				Issue: fmt.Sprintf("archive expands to more than %d bytes", limits.MaxTotalSize),
+			}
+		}
+
+		image, err := gs.CreateImage(galleryID, filename, bytes.NewReader(contents))
+		if err != nil {
+			result.Err = err
+		} else {
+			result.Filename = image.Filename
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// zipEntryName returns the name an archive entry is stored under, rejecting
+// names that try to escape the archive.
+func zipEntryName(name string) (string, error) {
+	name = strings.ReplaceAll(name, `\`, "/")
+	if path.IsAbs(name) || strings.Contains(name, ":") {
+		return "", FileError{Issue: "absolute paths are not allowed"}
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return "", FileError{Issue: "paths outside the archive are not allowed"}
+		}
+	}
+	base := path.Base(name)
+	if base == "." || base == "/" || strings.HasPrefix(base, ".") {
+		return "", FileError{Issue: "invalid file name"}
+	}
+	for _, r := range base {
+		if r < 0x20 || r == 0x7f {
+			return "", FileError{Issue: "invalid file name"}
+		}
+	}
+	return base, nil
+}
+
+// zipJunk reports whether an entry is metadata added by archivers rather
+// than a file the user meant to upload.
+func zipJunk(name string) bool {
+	base := path.Base(name)
+	return strings.HasPrefix(name, "__MACOSX/") || base == ".DS_Store" || base == "Thumbs.db" ||
+		strings.HasPrefix(base, "._")
+}
+
+func checkZipEntry(f *zip.File, limits ZipLimits) error {
+	if f.UncompressedSize64 > uint64(limits.MaxFileSize) {
+		return FileError{Issue: fmt.Sprintf("larger than %d bytes", limits.MaxFileSize)}
+	}
+	if f.CompressedSize64 > 0 && f.UncompressedSize64/f.CompressedSize64 > limits.MaxRatio {
+		return FileError{Issue: "compression ratio is suspiciously high"}
+	}
+	return nil
+}
+
+func readZipEntry(f *zip.File, maxSize int64) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("read zip entry: %w", err)
+	}
+	defer rc.Close()
+
+	contents, err := io.ReadAll(io.LimitReader(rc, maxSize+1))
+	if err != nil {
+		if errors.Is(err, zip.ErrChecksum) || errors.Is(err, zip.ErrFormat) {
+			return nil, FileError{Issue: "corrupt archive entry"}
+		}
+		return nil, fmt.Errorf("read zip entry: %w", err)
+	}
+	if int64(len(contents)) > maxSize {
+		return nil, FileError{Issue: fmt.Sprintf("larger than %d bytes", maxSize)}
+	}
+	return contents, nil
+}
+
+func (gs *GalleryService) zipLimits() ZipLimits {
+	limits := gs.ZipLimits
+	if limits.MaxEntries <= 0 {
+		limits.MaxEntries = DefaultZipMaxEntries
+	}
+	if limits.MaxFileSize <= 0 {
+		limits.MaxFileSize = DefaultZipMaxFileSize
+	}
+	if limits.MaxTotalSize <= 0 {
+		limits.MaxTotalSize = DefaultZipMaxTotalSize
+	}
+	if limits.MaxRatio == 0 {
+		limits.MaxRatio = DefaultZipMaxRatio
+	}
+	return limits
+}
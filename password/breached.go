@@ -0,0 +1,60 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Breached checks passwords against a local copy of the Have I Been Pwned
+// password hashes, split the way the k-anonymity range API serves them: Dir
+// holds one file per 5 character SHA-1 prefix, e.g. "21BD1.txt", each line
+// being the remaining 35 characters of a hash and a count, "SUFFIX:COUNT".
+//
+// Only the file for the password's prefix is read, so the dataset can be
+// synced from the range API without ever sending a full hash.
+type Breached struct {
+	Dir string
+}
+
+// Count returns how often password appears in the dataset. A missing prefix
+// file counts as not breached.
+func (b *Breached) Count(password string) (int, error) {
+	sum := sha1.Sum([]byte(password))
+	digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := digest[:5], digest[5:]
+
+	f, err := os.Open(filepath.Join(b.Dir, prefix+".txt"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("breached count: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		hashSuffix, count, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(hashSuffix, suffix) {
+			continue
+		}
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			return 0, fmt.Errorf("breached count: %s: %w", prefix, err)
+		}
+		return n, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("breached count: %w", err)
+	}
+	return 0, nil
+}
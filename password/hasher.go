@@ -0,0 +1,167 @@
+package password
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"example/web-go/rand"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrMismatch is returned by Verify when the password does not match.
+var ErrMismatch = errors.New("password: hash and password do not match")
+
+// Hasher hashes new passwords. The hash strings carry their algorithm and
+// parameters, so Verify can check any of them regardless of which Hasher is
+// configured today.
+type Hasher interface {
+	Hash(password string) (string, error)
+	// NeedsRehash reports whether hash was made with another algorithm or
+	// other parameters than this Hasher would use now.
+	NeedsRehash(hash string) bool
+}
+
+// Verify checks password against a hash made by any supported Hasher.
+func Verify(hash, password string) error {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return verifyArgon2id(hash, password)
+	case strings.HasPrefix(hash, "$2"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrMismatch
+		}
+		return err
+	default:
+		return fmt.Errorf("verify password: unknown hash format")
+	}
+}
+
+// Bcrypt hashes with bcrypt at Cost, which defaults to bcrypt.DefaultCost.
+type Bcrypt struct {
+	Cost int
+}
+
+func (b Bcrypt) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.cost())
+	if err != nil {
+		return "", fmt.Errorf("bcrypt: %w", err)
+	}
+	return string(hash), nil
+}
+
+func (b Bcrypt) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return true
+	}
+	return cost != b.cost()
+}
+
+func (b Bcrypt) cost() int {
+	if b.Cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return b.Cost
+}
+
+const (
+	DefaultArgon2Time    = 3
+	DefaultArgon2Memory  = 64 * 1024
+	DefaultArgon2Threads = 2
+
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// Argon2id hashes with argon2id. Zero fields use the defaults above. Hashes
+// are stored in the PHC string format:
+//
+//	$argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+type Argon2id struct {
+	Time uint32
+	// Memory is in KiB.
+	Memory  uint32
+	Threads uint8
+}
+
+type argon2Params struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+}
+
+func (a Argon2id) params() argon2Params {
+	p := argon2Params{time: a.Time, memory: a.Memory, threads: a.Threads}
+	if p.time == 0 {
+		p.time = DefaultArgon2Time
+	}
+	if p.memory == 0 {
+		p.memory = DefaultArgon2Memory
+	}
+	if p.threads == 0 {
+		p.threads = DefaultArgon2Threads
+	}
+	return p
+}
+
+func (a Argon2id) Hash(password string) (string, error) {
+	salt, err := rand.Bytes(argon2SaltLen)
+	if err != nil {
+		return "", fmt.Errorf("argon2id: %w", err)
+	}
+	p := a.params()
+	key := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.memory, p.time, p.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (a Argon2id) NeedsRehash(hash string) bool {
+	p, _, key, err := parseArgon2id(hash)
+	if err != nil {
+		return true
+	}
+	return p != a.params() || len(key) != argon2KeyLen
+}
+
+func verifyArgon2id(hash, password string) error {
+	p, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return err
+	}
+	other := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
+
+func parseArgon2id(hash string) (argon2Params, []byte, []byte, error) {
+	var p argon2Params
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, fmt.Errorf("parse argon2id: invalid hash")
+	}
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("parse argon2id: unsupported version")
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads)
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("parse argon2id: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("parse argon2id: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("parse argon2id: %w", err)
+	}
+	return p, salt, key, nil
+}
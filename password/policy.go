@@ -0,0 +1,91 @@
+// Package password decides which passwords users may choose.
+package password
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	DefaultMinLength = 8
+	// DefaultMaxBytes is where bcrypt stops reading; anything longer would
+	// be silently truncated.
+	DefaultMaxBytes = 72
+	DefaultMinScore = 2
+)
+
+// Error describes why a password was rejected. Issue is safe to show users.
+type Error struct {
+	Issue string
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("invalid password: %s", e.Issue)
+}
+
+// Policy is the set of rules for new passwords. The zero value applies the
+// defaults and skips the breach check.
+type Policy struct {
+	// MinLength is counted in characters. Defaults to DefaultMinLength.
+	MinLength int
+	// MaxBytes defaults to DefaultMaxBytes.
+	MaxBytes int
+	// MinScore is the lowest acceptable Score. Defaults to DefaultMinScore.
+	MinScore int
+	// Breached, if set, rejects passwords found in known breaches.
+	Breached *Breached
+}
+
+// Check returns an Error if password may not be used by the account with
+// email. Other errors come from the breach check.
+func (p Policy) Check(password, email string) error {
+	if utf8.RuneCountInString(password) < p.minLength() {
+		return Error{Issue: fmt.Sprintf("Password must be at least %d characters long.", p.minLength())}
+	}
+	if len(password) > p.maxBytes() {
+		return Error{Issue: fmt.Sprintf("Password must be at most %d bytes long.", p.maxBytes())}
+	}
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email != "" {
+		lower := strings.ToLower(password)
+		local, _, _ := strings.Cut(email, "@")
+		if lower == email || lower == local {
+			return Error{Issue: "Password must not be your email address."}
+		}
+	}
+	if Score(password, email) < p.minScore() {
+		return Error{Issue: "Password is too easy to guess. Try a longer passphrase or mix in more words."}
+	}
+	if p.Breached != nil {
+		count, err := p.Breached.Count(password)
+		if err != nil {
+			return fmt.Errorf("check password: %w", err)
+		}
+		if count > 0 {
+			return Error{Issue: "This password has appeared in a data breach. Please choose a different one."}
+		}
+	}
+	return nil
+}
+
+func (p Policy) minLength() int {
+	if p.MinLength == 0 {
+		return DefaultMinLength
+	}
+	return p.MinLength
+}
+
+func (p Policy) maxBytes() int {
+	if p.MaxBytes == 0 {
+		return DefaultMaxBytes
+	}
+	return p.MaxBytes
+}
+
+func (p Policy) minScore() int {
+	if p.MinScore == 0 {
+		return DefaultMinScore
+	}
+	return p.MinScore
+}
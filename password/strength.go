@@ -0,0 +1,133 @@
+package password
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// commonPasswords are base words that make up a large share of guessed
+// passwords. Matching one costs the attacker a handful of guesses.
+var commonPasswords = map[string]bool{
+	"password": true, "passw0rd": true, "qwerty": true, "qwertyuiop": true,
+	"letmein": true, "welcome": true, "admin": true, "administrator": true,
+	"iloveyou": true, "monkey": true, "dragon": true, "football": true,
+	"baseball": true, "master": true, "sunshine": true, "princess": true,
+	"shadow": true, "superman": true, "trustno1": true, "starwars": true,
+	"login": true, "abc": true, "abcdef": true, "asdf": true, "asdfgh": true,
+	"zxcvbn": true, "hello": true, "freedom": true, "whatever": true,
+	"secret": true, "changeme": true, "default": true, "root": true,
+	"batman": true, "michael": true, "jennifer": true, "charlie": true,
+}
+
+// Score estimates how hard password is to guess on zxcvbn's scale from 0
+// (trivial) to 4 (very strong). userInputs, such as the email address, are
+// treated as known to an attacker.
+//
+// The estimate is deliberately simple: it counts the length left after
+// discounting repeats, sequences, keyboard runs and known words, and the size
+// of the alphabet used.
+func Score(password string, userInputs ...string) int {
+	lower := strings.ToLower(password)
+	if commonPasswords[strings.TrimRightFunc(lower, isDigitOrSymbol)] {
+		return 0
+	}
+
+	effective := float64(effectiveLength(lower))
+	for _, input := range userInputs {
+		for _, part := range strings.FieldsFunc(strings.ToLower(input), isDigitOrSymbol) {
+			if len(part) >= 3 && strings.Contains(lower, part) {
+				effective -= float64(len(part) - 1)
+			}
+		}
+	}
+	if effective < 1 {
+		effective = 1
+	}
+
+	bits := effective * math.Log2(float64(alphabetSize(password)))
+	guesses := bits * math.Log10(2)
+	switch {
+	case guesses < 3:
+		return 0
+	case guesses < 6:
+		return 1
+	case guesses < 8:
+		return 2
+	case guesses < 10:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// effectiveLength counts characters, counting a run of repeated characters or
+// a sequence such as "abcd", "4321" or "qwer" as a single character.
+func effectiveLength(s string) int {
+	runes := []rune(s)
+	n := 0
+	for i := 0; i < len(runes); i++ {
+		n++
+		if i == 0 {
+			continue
+		}
+		if predictable(runes[i-1], runes[i]) && (i < 2 || predictable(runes[i-2], runes[i-1])) {
+			n--
+		}
+	}
+	return n
+}
+
+const keyboardRows = "qwertyuiop asdfghjkl zxcvbnm 1234567890"
+
+func predictable(prev, cur rune) bool {
+	diff := cur - prev
+	if diff >= -1 && diff <= 1 {
+		return true
+	}
+	i := strings.IndexRune(keyboardRows, prev)
+	j := strings.IndexRune(keyboardRows, cur)
+	return i >= 0 && j >= 0 && (j-i == 1 || i-j == 1)
+}
+
+func alphabetSize(s string) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	size := 0
+	if lower {
+		size += 26
+	}
+	if upper {
+		size += 26
+	}
+	if digit {
+		size += 10
+	}
+	if symbol {
+		size += 33
+	}
+	if other {
+		size += 100
+	}
+	if size == 0 {
+		size = 1
+	}
+	return size
+}
+
+func isDigitOrSymbol(r rune) bool {
+	return !unicode.IsLetter(r)
+}
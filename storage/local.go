@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Local stores objects as files below Dir.
+type Local struct {
+	Dir string
+}
+
+// tempPrefix marks files that are still being written by Put. They are
+// hidden from List.
+const tempPrefix = ".tmp-"
+
+// Put writes to a temporary file next to the destination and renames it into
+// place, so readers see either the old object or the complete new one.
+func (l Local) Put(key string, r io.Reader, contentType string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	dst, err := os.CreateTemp(filepath.Dir(p), tempPrefix+"*")
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	_, err = io.Copy(dst, r)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	err = dst.Close()
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	// CreateTemp makes the file private to the owner.
+	err = os.Chmod(dst.Name(), 0644)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	err = os.Rename(dst.Name(), p)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	return nil
+}
+
+// Get returns the underlying *os.File, so callers may type assert to
+// io.ReadSeeker to serve range requests.
+func (l Local) Get(key string) (io.ReadCloser, ObjectInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, ObjectInfo{}, fmt.Errorf("get %v: %w", key, err)
+	}
+	file, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ObjectInfo{}, ErrNotExist
+		}
+		return nil, ObjectInfo{}, fmt.Errorf("get %v: %w", key, err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, ObjectInfo{}, fmt.Errorf("get %v: %w", key, err)
+	}
+	return file, l.info(key, stat), nil
+}
+
+func (l Local) Delete(key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return fmt.Errorf("delete %v: %w", key, err)
+	}
+	err = os.Remove(p)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("delete %v: %w", key, err)
+	}
+	return nil
+}
+
+func (l Local) List(prefix string) ([]ObjectInfo, error) {
+	// Walk the deepest directory that contains every possible match.
+	dir := prefix
+	if !strings.HasSuffix(dir, "/") {
+		dir = path.Dir(dir)
+	}
+	root, err := l.path(dir)
+	if err != nil {
+		return nil, fmt.Errorf("list %v: %w", prefix, err)
+	}
+
+	var objects []ObjectInfo
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(l.dir(), p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		stat, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, l.info(key, stat))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list %v: %w", prefix, err)
+	}
+	return objects, nil
+}
+
+func (l Local) Stat(key string) (ObjectInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("stat %v: %w", key, err)
+	}
+	stat, err := os.Stat(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ObjectInfo{}, ErrNotExist
+		}
+		return ObjectInfo{}, fmt.Errorf("stat %v: %w", key, err)
+	}
+	if stat.IsDir() {
+		return ObjectInfo{}, ErrNotExist
+	}
+	return l.info(key, stat), nil
+}
+
+func (l Local) info(key string, stat fs.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:         key,
+		Size:        stat.Size(),
+		ModTime:     stat.ModTime(),
+		ContentType: mime.TypeByExtension(path.Ext(key)),
+	}
+}
+
+func (l Local) dir() string {
+	if l.Dir == "" {
+		return "images"
+	}
+	return l.Dir
+}
+
+// path maps key to a file below the store directory, rejecting keys that
+// would escape it.
+func (l Local) path(key string) (string, error) {
+	key = strings.TrimSuffix(key, "/")
+	if key == "" || key == "." {
+		return l.dir(), nil
+	}
+	if !fs.ValidPath(key) {
+		return "", fmt.Errorf("invalid key")
+	}
+	return filepath.Join(l.dir(), filepath.FromSlash(key)), nil
+}
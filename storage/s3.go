@@ -0,0 +1,336 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3TimeFormat      = "20060102T150405Z"
+	s3DateFormat      = "20060102"
+)
+
+type S3Config struct {
+	// Endpoint is the base URL of the service, for example
+	// https://s3.eu-west-1.amazonaws.com or http://localhost:9000 for MinIO.
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// PathStyle addresses the bucket as a path segment instead of a subdomain.
+	// MinIO and most self-hosted stores need this.
+	PathStyle bool
+}
+
+// S3 stores objects in a bucket of an S3-compatible service. Requests are
+// signed with AWS Signature Version 4.
+type S3 struct {
+	Config S3Config
+	Client *http.Client
+}
+
+func NewS3(config S3Config) *S3 {
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	return &S3{
+		Config: config,
+		Client: &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+func (s *S3) Put(key string, r io.Reader, contentType string) error {
+	body, size, err := sizedBody(r)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	req, err := s.newRequest(http.MethodPut, key, nil, body)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Get(key string) (io.ReadCloser, ObjectInfo, error) {
+	req, err := s.newRequest(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, ObjectInfo{}, fmt.Errorf("get %v: %w", key, err)
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, ObjectInfo{}, fmt.Errorf("get %v: %w", key, err)
+	}
+	return resp.Body, objectInfo(key, resp), nil
+}
+
+func (s *S3) Delete(key string) error {
+	req, err := s.newRequest(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return fmt.Errorf("delete %v: %w", key, err)
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		if errors.Is(err, ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("delete %v: %w", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	var continuation string
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+		}
+		if continuation != "" {
+			query.Set("continuation-token", continuation)
+		}
+		req, err := s.newRequest(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, fmt.Errorf("list %v: %w", prefix, err)
+		}
+		resp, err := s.do(req)
+		if err != nil {
+			return nil, fmt.Errorf("list %v: %w", prefix, err)
+		}
+
+		var result struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("list %v: decode response: %w", prefix, err)
+		}
+
+		for _, c := range result.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:     c.Key,
+				Size:    c.Size,
+				ModTime: c.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		continuation = result.NextContinuationToken
+	}
+}
+
+func (s *S3) Stat(key string) (ObjectInfo, error) {
+	req, err := s.newRequest(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("stat %v: %w", key, err)
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		if errors.Is(err, ErrNotExist) {
+			return ObjectInfo{}, ErrNotExist
+		}
+		return ObjectInfo{}, fmt.Errorf("stat %v: %w", key, err)
+	}
+	resp.Body.Close()
+	return objectInfo(key, resp), nil
+}
+
+// do sends a signed request. Missing objects are reported as ErrNotExist and
+// any other non-2xx status as an error carrying the service's message.
+func (s *S3) do(req *http.Request) (*http.Response, error) {
+	s.sign(req, time.Now().UTC())
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotExist
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	return nil, fmt.Errorf("s3: %s: %s", resp.Status, bytes.TrimSpace(msg))
+}
+
+func (s *S3) newRequest(method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	endpoint, err := url.Parse(s.Config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parse endpoint: %w", err)
+	}
+
+	u := url.URL{
+		Scheme: endpoint.Scheme,
+		Host:   endpoint.Host,
+	}
+	objectPath := "/" + key
+	if s.Config.PathStyle {
+		objectPath = "/" + s.Config.Bucket + objectPath
+	} else {
+		u.Host = s.Config.Bucket + "." + endpoint.Host
+	}
+	u.Path = strings.TrimSuffix(endpoint.Path, "/") + objectPath
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	return http.NewRequest(method, u.String(), body)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req. The
+// payload is not hashed so bodies can be streamed.
+func (s *S3) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format(s3TimeFormat)
+	date := now.Format(s3DateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + s3UnsignedPayload + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		s3UnsignedPayload,
+	}, "\n")
+
+	scope := date + "/" + s.Config.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.Config.SecretAccessKey), date)
+	key = hmacSHA256(key, s.Config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.Config.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func objectInfo(key string, resp *http.Response) ObjectInfo {
+	info := ObjectInfo{
+		Key:         key,
+		Size:        resp.ContentLength,
+		ContentType: resp.Header.Get("Content-Type"),
+	}
+	if size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		info.Size = size
+	}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+	return info
+}
+
+// sizedBody determines the length of r. Seekable readers are streamed as is,
+// anything else is buffered since S3 requires a Content-Length.
+func sizedBody(r io.Reader) (io.Reader, int64, error) {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		cur, err := rs.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, 0, err
+		}
+		end, err := rs.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, 0, err
+		}
+		_, err = rs.Seek(cur, io.SeekStart)
+		if err != nil {
+			return nil, 0, err
+		}
+		return rs, end - cur, nil
+	}
+	var buf bytes.Buffer
+	_, err := io.Copy(&buf, r)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(buf.Bytes()), int64(buf.Len()), nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted by key as required for signing.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything but the unreserved characters of
+// RFC 3986, which is the encoding Signature Version 4 expects.
+func uriEncode(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			sb.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,50 @@
+// Package storage abstracts where gallery image blobs are kept so the server
+// can run against the local disk or an S3-compatible object store.
+package storage
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	ErrNotExist = errors.New("storage: object does not exist")
+)
+
+// ObjectInfo describes a stored object. Keys always use forward slashes.
+type ObjectInfo struct {
+	Key         string
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+}
+
+type Store interface {
+	// Put stores the contents of r under key, replacing any existing object.
+	Put(key string, r io.Reader, contentType string) error
+	// Get opens the object stored under key. The caller must close the reader.
+	Get(key string) (io.ReadCloser, ObjectInfo, error)
+	// Delete removes the object stored under key. Deleting a missing object is
+	// not an error.
+	Delete(key string) error
+	// List returns every object whose key starts with prefix.
+	List(prefix string) ([]ObjectInfo, error)
+	// Stat returns information about the object stored under key.
+	Stat(key string) (ObjectInfo, error)
+}
+
+// DeletePrefix removes every object whose key starts with prefix.
+func DeletePrefix(s Store, prefix string) error {
+	objects, err := s.List(prefix)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		err := s.Delete(obj.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+// Memory keeps buckets in process. Counts are lost on restart and are not
+// shared between instances.
+type Memory struct {
+	// IdleTimeout defaults to DefaultIdleTimeout.
+	IdleTimeout time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func (m *Memory) Take(key string, limit Limit) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if m.buckets == nil {
+		m.buckets = make(map[string]*bucket)
+	}
+	b, ok := m.buckets[key]
+	if !ok {
+		nb := newBucket(limit, now)
+		b = &nb
+		m.buckets[key] = b
+	}
+	allowed, retryAfter := b.take(limit, now)
+	return allowed, retryAfter, nil
+}
+
+// DeleteIdle forgets buckets that have not been used for IdleTimeout, which
+// are full again by then. It has the signature of a models.SweepFunc.
+func (m *Memory) DeleteIdle() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := time.Now().Add(-m.idleTimeout())
+	var n int64
+	for key, b := range m.buckets {
+		if b.updatedAt.Before(cutoff) {
+			delete(m.buckets, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *Memory) idleTimeout() time.Duration {
+	if m.IdleTimeout == 0 {
+		return DefaultIdleTimeout
+	}
+	return m.IdleTimeout
+}
@@ -0,0 +1,62 @@
+package throttle
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Postgres keeps buckets in the throttle_buckets table so every instance sees
+// the same counts.
+type Postgres struct {
+	DB *sql.DB
+	// IdleTimeout defaults to DefaultIdleTimeout.
+	IdleTimeout time.Duration
+}
+
+func (p *Postgres) Take(key string, limit Limit) (bool, time.Duration, error) {
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return false, 0, fmt.Errorf("take: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	b := newBucket(limit, now)
+	_, err = tx.Exec(`
+	INSERT INTO throttle_buckets (key, tokens, updated_at) VALUES ($1, $2, $3)
+	ON CONFLICT (key) DO NOTHING`, key, b.tokens, b.updatedAt)
+	if err != nil {
+		return false, 0, fmt.Errorf("take: %w", err)
+	}
+	row := tx.QueryRow(`SELECT tokens, updated_at FROM throttle_buckets WHERE key=$1 FOR UPDATE`, key)
+	err = row.Scan(&b.tokens, &b.updatedAt)
+	if err != nil {
+		return false, 0, fmt.Errorf("take: %w", err)
+	}
+
+	allowed, retryAfter := b.take(limit, now)
+	_, err = tx.Exec(`UPDATE throttle_buckets SET tokens=$2, updated_at=$3 WHERE key=$1`, key, b.tokens, b.updatedAt)
+	if err != nil {
+		return false, 0, fmt.Errorf("take: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return false, 0, fmt.Errorf("take: %w", err)
+	}
+	return allowed, retryAfter, nil
+}
+
+// DeleteIdle removes buckets that have not been used for IdleTimeout. It has
+// the signature of a models.SweepFunc.
+func (p *Postgres) DeleteIdle() (int64, error) {
+	idle := p.IdleTimeout
+	if idle == 0 {
+		idle = DefaultIdleTimeout
+	}
+	result, err := p.DB.Exec(`DELETE FROM throttle_buckets WHERE updated_at < $1`, time.Now().Add(-idle))
+	if err != nil {
+		return 0, fmt.Errorf("delete idle: %w", err)
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,74 @@
+// Package throttle rate limits actions with token buckets. Buckets live in a
+// Store, either in memory for a single instance or in Postgres when several
+// instances have to share counts.
+package throttle
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// DefaultIdleTimeout is how long a bucket may go unused before stores forget
+// it. It must be longer than the time any Limit needs to refill completely.
+const DefaultIdleTimeout = 24 * time.Hour
+
+// Limit allows Burst attempts at once, refilling Burst attempts every Per.
+type Limit struct {
+	Burst int
+	Per   time.Duration
+}
+
+// rate returns the refill rate in tokens per second.
+func (l Limit) rate() float64 {
+	return float64(l.Burst) / l.Per.Seconds()
+}
+
+// Store keeps token buckets by key.
+type Store interface {
+	// Take removes a token from the bucket for key. If the bucket is empty
+	// it reports false and how long until a token is available.
+	Take(key string, limit Limit) (bool, time.Duration, error)
+}
+
+// Limiter applies Limit to keys under a common Name, e.g. "signin:ip".
+type Limiter struct {
+	Store Store
+	Name  string
+	Limit Limit
+}
+
+// Allow records an attempt for key and reports whether it may go ahead. When
+// it may not, the returned duration says when to retry.
+func (l Limiter) Allow(key string) (bool, time.Duration, error) {
+	ok, retryAfter, err := l.Store.Take(l.Name+":"+key, l.Limit)
+	if err != nil {
+		return false, 0, fmt.Errorf("throttle %s: %w", l.Name, err)
+	}
+	return ok, retryAfter, nil
+}
+
+// bucket is the state of one key. Stores persist it however they like and
+// use take to apply an attempt.
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+func newBucket(limit Limit, now time.Time) bucket {
+	return bucket{tokens: float64(limit.Burst), updatedAt: now}
+}
+
+func (b *bucket) take(limit Limit, now time.Time) (bool, time.Duration) {
+	elapsed := now.Sub(b.updatedAt).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed*limit.rate())
+		b.updatedAt = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := (1 - b.tokens) / limit.rate()
+	return false, time.Duration(math.Ceil(wait)) * time.Second
+}